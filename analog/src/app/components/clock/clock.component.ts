@@ -189,60 +189,25 @@ export class ClockComponent implements OnInit {
       }
     }
 
-    // Handle double clocking
-    if (state === "I" && jobRef.value.inStatus) {
-      this.logDialogBoxClicks("none", "Double Clock In Dialog Box Opening");
-      this.dialog.open(DoubleDialog, {
-        data: {
-          msg: "Are you sure you want to clock in again?"
-        }
-      })
-        .afterClosed()
-        .subscribe(confirmed => {
-          if (confirmed === "cancel") {
-            this.logDialogBoxClicks("cancel_double_clock", "Clicked Cancel Button");
-            this.clockingInProgress = false; 
-            return;
-          } else if (confirmed === "continue") {
-            this.logDialogBoxClicks("continue_double_clock", "Clicked Continue Button");
-            this.sendPunch(jobRef, state, tec);
-          }
-        });
-    } else if (state === "O" && !jobRef.value.inStatus) {
-      this.logDialogBoxClicks("none", "Double Clock In Dialog Box Opening");
-      this.dialog.open(DoubleDialog, {
-        data: {
-          msg: "Are you sure you want to clock out again?"
-        }
-      })
-        .afterClosed()
-        .subscribe(confirmed => {
-          if (confirmed === "cancel") {
-            this.logDialogBoxClicks("cancel_double_clock", "Clicked Cancel Button");
-            this.clockingInProgress = false; 
-            return;
-          } else if (confirmed === "continue") {
-            this.logDialogBoxClicks("continue_double_clock", "Clicked Continue Button");
-            this.sendPunch(jobRef, state, tec);
-          }
-        });
-    } else {
-      this.sendPunch(jobRef, state, tec);
-    }
-  };
-
-  sendPunch = (jobRef: BehaviorSubject<Position>, state: PunchType, tec: string) => {
+    // the server decides whether the punch contradicts the job's clock state and needs confirming
     const data = new PunchRequest();
     data.id = this.emp.id;
     data.positionNumber = String(jobRef.value.positionNumber);
     data.clockEventType = state === "I" ? "IN" : "OUT";
     data.timeEntryCode = tec;
+    data.punchID = PunchRequest.newPunchID();
+    data.time = new Date().toISOString();
+    this.sendPunch(data);
+  };
+
+  // a resent punch keeps its punch ID and time, so the server only records it once and at the time it was made
+  sendPunch = (data: PunchRequest) => {
 
     const obs = this.api.punch(data).pipe(share());
     obs.subscribe({
       next: (resp) => {
         const response = JSON.parse(resp); 
-        if (response.written_to_tcd === 'true') {
+        if (response.written_to_tcd === 'true' || response.queued === 'true' || response.workday_reference_id) {
           this.logDialogBoxClicks("", "Punch Confirmation Dialog Box Opening");
           this.dialog.open(ConfirmDialog, {
             data: { state: data.clockEventType }
@@ -268,6 +233,10 @@ export class ClockComponent implements OnInit {
         }
       },
       error: (err) => {
+        if (err.status === 409) {
+          this.punchConflict(data, JSON.parse(err.error));
+          return;
+        }
         this.refreshPage();
         console.warn("response ERROR", err);
         this.logDialogBoxClicks("", "Punch Error Dialog Box Opening");
@@ -290,6 +259,41 @@ export class ClockComponent implements OnInit {
     });
   };
 
+  // the punch contradicts the job's clock state, so ask before resending it or explain why it was refused
+  punchConflict = (data: PunchRequest, conflict: any) => {
+    if (!conflict.confirm_required) {
+      this.clockingInProgress = false;
+      this.refreshPage();
+      this.logDialogBoxClicks("", "Punch Conflict Error Dialog Box Opening");
+      this.dialog.open(ErrorDialog, {
+        data: {
+          msg: conflict.message
+        }
+      });
+      return;
+    }
+
+    const question = data.clockEventType === "IN" ? " Are you sure you want to clock in again?" : " Are you sure you want to clock out?";
+    this.logDialogBoxClicks("none", "Double Clock In Dialog Box Opening");
+    this.dialog.open(DoubleDialog, {
+      data: {
+        msg: conflict.message + question
+      }
+    })
+      .afterClosed()
+      .subscribe(confirmed => {
+        if (confirmed === "cancel") {
+          this.logDialogBoxClicks("cancel_double_clock", "Clicked Cancel Button");
+          this.clockingInProgress = false;
+          return;
+        } else if (confirmed === "continue") {
+          this.logDialogBoxClicks("continue_double_clock", "Clicked Continue Button");
+          data.confirm = true;
+          this.sendPunch(data);
+        }
+      });
+  };
+
   logTimesheetClick = () => {
     console.log("Logging to timesheet button clicked by " + this.emp.id);
     var log = new Log();
@@ -433,8 +433,23 @@ export class Position {
  @JsonProperty('clocked_in', BoolConverter)
  inStatus: boolean = false;
 
+ @JsonProperty('clock_state', String, true)
+ clockState: string = undefined;
+
  days = Array<Day>();
 
+ // a message to show the student when their punches for this position don't line up
+ clockWarning(): string {
+   switch (this.clockState) {
+     case 'missing-out':
+       return 'Missing clock out - please contact your supervisor';
+     case 'double-in':
+       return 'Clocked in twice - please contact your supervisor';
+     default:
+       return '';
+   }
+ }
+
 }
 
 
@@ -512,6 +527,25 @@ export class PunchRequest {
 
   @JsonProperty("time_entry_code", TECConverter)
   timeEntryCode: any = null;
+
+  @JsonProperty("punch_id", String, true)
+  punchID: string = undefined;
+
+  // when the punch button was pressed, as an ISO 8601 string
+  @JsonProperty("time_clock_event_date_time", String, true)
+  time: string = undefined;
+
+  @JsonProperty("confirm", Boolean, true)
+  confirm: boolean = false;
+
+  // a random (v4) UUID the server uses to record a retried punch only once
+  static newPunchID(): string {
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    bytes[6] = (bytes[6] & 0x0f) | 0x40;
+    bytes[8] = (bytes[8] & 0x3f) | 0x80;
+    const hex = Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+    return `${hex.slice(0, 8)}-${hex.slice(8, 12)}-${hex.slice(12, 16)}-${hex.slice(16, 20)}-${hex.slice(20)}`;
+  }
 }
 
 @JsonObject("Log")
@@ -0,0 +1,85 @@
+// Package clockstate works out whether a worker is clocked in to a position by replaying their
+// time blocks and punches in the order they happened.
+package clockstate
+
+import (
+	"sort"
+	"time"
+)
+
+type State string
+
+const (
+	// ClockedOut means every IN has a matching OUT
+	ClockedOut State = "clocked-out"
+	// ClockedIn means the latest IN has no OUT yet and is recent
+	ClockedIn State = "clocked-in"
+	// MissingOut means the latest IN has no OUT and is older than the missing out threshold
+	MissingOut State = "missing-out"
+	// DoubleIn means there was an IN while already clocked in, and neither has an OUT yet
+	DoubleIn State = "double-in"
+)
+
+// IsIn reports whether the next punch for the position should be an OUT
+func (s State) IsIn() bool {
+	return s == ClockedIn || s == MissingOut || s == DoubleIn
+}
+
+// Event is a single check-in or check-out
+type Event struct {
+	Time time.Time
+	In   bool
+}
+
+// Result is the state of one position after replaying its events
+type Result struct {
+	State State
+	// Since is the time of the IN that is still open, zero when clocked out
+	Since time.Time
+}
+
+// Replay walks the events oldest first and returns the state they leave the position in.
+//
+// An OUT with nothing open is ignored, since the IN it belongs to is usually in an earlier pay period.
+// An IN while already clocked in starts over from the newer IN, but is reported as DoubleIn until an
+// OUT closes it. The same punch showing up twice, e.g. in a time block and as a TCD punch that hasn't
+// been uploaded yet, is only counted once.
+func Replay(events []Event, now time.Time, missingOutAfter time.Duration) Result {
+	events = append([]Event(nil), events...)
+	// at the same instant an IN goes first, so a zero length block still ends clocked out
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Time.Equal(events[j].Time) {
+			return events[i].In && !events[j].In
+		}
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	var open, doubled bool
+	var since time.Time
+	for i, e := range events {
+		if i > 0 && e.In == events[i-1].In && e.Time.Equal(events[i-1].Time) {
+			continue
+		}
+		switch {
+		case e.In && open:
+			doubled = true
+			since = e.Time
+		case e.In:
+			open = true
+			since = e.Time
+		case open:
+			open, doubled = false, false
+			since = time.Time{}
+		}
+	}
+
+	switch {
+	case !open:
+		return Result{State: ClockedOut}
+	case doubled:
+		return Result{State: DoubleIn, Since: since}
+	case missingOutAfter > 0 && now.Sub(since) > missingOutAfter:
+		return Result{State: MissingOut, Since: since}
+	}
+	return Result{State: ClockedIn, Since: since}
+}
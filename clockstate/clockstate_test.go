@@ -0,0 +1,55 @@
+package clockstate
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 3, 12, 17, 0, 0, 0, time.FixedZone("MDT", -6*60*60))
+
+func in(hoursAgo float64) Event {
+	return Event{Time: now.Add(-time.Duration(hoursAgo * float64(time.Hour))), In: true}
+}
+
+func out(hoursAgo float64) Event {
+	return Event{Time: now.Add(-time.Duration(hoursAgo * float64(time.Hour)))}
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    []Event
+		wantState State
+		wantSince time.Time
+	}{
+		{"no events", nil, ClockedOut, time.Time{}},
+		{"in", []Event{in(1)}, ClockedIn, in(1).Time},
+		{"in then out", []Event{in(3), out(1)}, ClockedOut, time.Time{}},
+		{"out of order", []Event{out(1), in(3)}, ClockedOut, time.Time{}},
+		{"in after a finished shift", []Event{in(8), out(6), in(1)}, ClockedIn, in(1).Time},
+		{"out with nothing open", []Event{out(2)}, ClockedOut, time.Time{}},
+		{"out with nothing open then in", []Event{out(2), in(1)}, ClockedIn, in(1).Time},
+		{"in older than the threshold", []Event{in(13)}, MissingOut, in(13).Time},
+		{"in just under the threshold", []Event{in(11.9)}, ClockedIn, in(11.9).Time},
+		{"two ins", []Event{in(3), in(1)}, DoubleIn, in(1).Time},
+		{"two ins closed by an out", []Event{in(3), in(2), out(1)}, ClockedOut, time.Time{}},
+		{"double in is reported before missing out", []Event{in(20), in(14)}, DoubleIn, in(14).Time},
+		{"same in from a block and a punch", []Event{in(2), in(2)}, ClockedIn, in(2).Time},
+		{"zero length block", []Event{out(2), in(2)}, ClockedOut, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Replay(tt.events, now, 12*time.Hour)
+			if got.State != tt.wantState || !got.Since.Equal(tt.wantSince) {
+				t.Errorf("Replay() = %s since %s, want %s since %s", got.State, got.Since, tt.wantState, tt.wantSince)
+			}
+		})
+	}
+}
+
+func TestReplayWithoutThreshold(t *testing.T) {
+	if got := Replay([]Event{in(100)}, now, 0); got.State != ClockedIn {
+		t.Errorf("Replay() = %s, want %s when the threshold is off", got.State, ClockedIn)
+	}
+}
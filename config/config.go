@@ -0,0 +1,184 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Get returns the setting called name. If name_FILE is set the setting is read from that file, such as a
+// mounted Kubernetes secret, otherwise it comes from the environment variable.
+func Get(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	return readFile(path)
+}
+
+func readFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// secrets are usually written with a trailing newline
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// ValidationError lists everything wrong with the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Loader reads settings with Get, collecting every problem so they can be reported together by Err
+type Loader struct {
+	problems []string
+}
+
+// Get returns the setting called name, or "" if it isn't set
+func (l *Loader) Get(name string) string {
+	value, err := Get(name)
+	if err != nil {
+		l.Problem(fmt.Errorf("%s_FILE can not be read: %w", name, err))
+	}
+	return value
+}
+
+// Required returns the setting called name, which must be set
+func (l *Loader) Required(name string) string {
+	value, err := Get(name)
+	switch {
+	case err != nil:
+		l.Problem(fmt.Errorf("%s_FILE can not be read: %w", name, err))
+	case value != "":
+	case os.Getenv(name+"_FILE") != "":
+		l.Problem(fmt.Errorf("%s_FILE is empty", name))
+	default:
+		l.Problem(fmt.Errorf("%s must be set", name))
+	}
+	return value
+}
+
+// Int returns the setting called name as a positive whole number, or def if it isn't set
+func (l *Loader) Int(name string, def int) int {
+	value := l.Get(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		l.Problem(fmt.Errorf("%s must be a positive whole number, not %q", name, value))
+		return def
+	}
+	return n
+}
+
+// Duration returns the setting called name as a positive duration like 5s, or def if it isn't set
+func (l *Loader) Duration(name string, def time.Duration) time.Duration {
+	value := l.Get(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		l.Problem(fmt.Errorf("%s must be a positive duration like 5s, not %q", name, value))
+		return def
+	}
+	return d
+}
+
+// DurationAtLeast returns the setting called name as a duration of at least min, or def if it isn't set
+func (l *Loader) DurationAtLeast(name string, def time.Duration, min time.Duration) time.Duration {
+	value := l.Get(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < min {
+		l.Problem(fmt.Errorf("%s must be a duration of at least %s, not %q", name, min, value))
+		return def
+	}
+	return d
+}
+
+// Problem records something wrong with the configuration
+func (l *Loader) Problem(err error) {
+	l.problems = append(l.problems, err.Error())
+}
+
+// Err returns a *ValidationError if there were any problems
+func (l *Loader) Err() error {
+	if len(l.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: l.problems}
+}
+
+type watch struct {
+	name  string
+	path  string
+	value string
+	fn    func(value string)
+}
+
+var (
+	watchesMu sync.Mutex
+	watches   []*watch
+)
+
+// Watch calls fn with the new value each time the file in name_FILE changes, once Run is started.
+// Settings that come straight from the environment can't change, so they aren't watched.
+func Watch(name string, fn func(value string)) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return
+	}
+	value, _ := readFile(path)
+
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+	watches = append(watches, &watch{name: name, path: path, value: value, fn: fn})
+}
+
+// Run checks the watched files every interval until ctx is done
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Reload()
+		}
+	}
+}
+
+// Reload checks the watched files once, calling the watchers of any that changed
+func Reload() {
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+	for _, w := range watches {
+		value, err := readFile(w.path)
+		if err != nil {
+			// kubernetes swaps the file out from under us, so it can briefly be missing
+			slog.Warn("can not read watched setting", "name", w.name, "path", w.path, "error", err)
+			continue
+		}
+		if value == w.value || value == "" {
+			continue
+		}
+		w.value = value
+		slog.Info("setting changed, reloading", "name", w.name)
+		w.fn(value)
+	}
+}
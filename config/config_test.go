@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoaderReadsFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	err := os.WriteFile(path, []byte("s3cret pass\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PASSWORD", "from-env")
+	t.Setenv("TEST_PASSWORD_FILE", path)
+	t.Setenv("TEST_USER", "user")
+
+	var l Loader
+	if got := l.Required("TEST_PASSWORD"); got != "s3cret pass" {
+		t.Errorf("Required(TEST_PASSWORD) = %q, want the file's contents", got)
+	}
+	if got := l.Required("TEST_USER"); got != "user" {
+		t.Errorf("Required(TEST_USER) = %q, want user", got)
+	}
+	if err := l.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
+
+func TestLoaderReportsEveryProblem(t *testing.T) {
+	t.Setenv("TEST_MISSING_FILE", filepath.Join(t.TempDir(), "nope"))
+	t.Setenv("TEST_TIMEOUT", "soon")
+	t.Setenv("TEST_DAYS", "-3")
+	t.Setenv("TEST_INTERVAL", "0s")
+
+	var l Loader
+	l.Required("TEST_NOT_SET")
+	l.Required("TEST_MISSING")
+	if got := l.Duration("TEST_TIMEOUT", time.Second); got != time.Second {
+		t.Errorf("Duration() = %s, want the default", got)
+	}
+	if got := l.Int("TEST_DAYS", 31); got != 31 {
+		t.Errorf("Int() = %d, want the default", got)
+	}
+	if got := l.Int("TEST_UNSET_DAYS", 31); got != 31 {
+		t.Errorf("Int() = %d, want the default", got)
+	}
+	if got := l.DurationAtLeast("TEST_INTERVAL", time.Minute, time.Second); got != time.Minute {
+		t.Errorf("DurationAtLeast() = %s, want the default", got)
+	}
+
+	var validation *ValidationError
+	if !errors.As(l.Err(), &validation) {
+		t.Fatalf("Err() = %v, want a *ValidationError", l.Err())
+	}
+	want := []string{"TEST_NOT_SET must be set", "TEST_MISSING_FILE can not be read", "TEST_TIMEOUT must be a positive duration", "TEST_DAYS must be a positive whole number", "TEST_INTERVAL must be a duration of at least 1s"}
+	if len(validation.Problems) != len(want) {
+		t.Errorf("got problems %q, want %d", validation.Problems, len(want))
+	}
+	for _, w := range want {
+		if !strings.Contains(validation.Error(), w) {
+			t.Errorf("Err() = %q, should contain %q", validation.Error(), w)
+		}
+	}
+}
+
+func TestWatchReloadsChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(path, []byte("one\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECRET_FILE", path)
+	defer func() { watches = nil }()
+
+	var got []string
+	Watch("TEST_SECRET", func(value string) { got = append(got, value) })
+	Watch("TEST_FROM_ENV", func(value string) { t.Error("settings from the environment should not be watched") })
+
+	Reload()
+	if len(got) != 0 {
+		t.Errorf("watcher called with %q before the file changed", got)
+	}
+
+	err = os.WriteFile(path, []byte("two\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Reload()
+	Reload()
+	if len(got) != 1 || got[0] != "two" {
+		t.Errorf("watcher called with %q, want [two]", got)
+	}
+
+	// a secret that is briefly missing while it is swapped out keeps its old value
+	os.Remove(path)
+	Reload()
+	if len(got) != 1 {
+		t.Errorf("watcher called with %q after the file was removed", got)
+	}
+}
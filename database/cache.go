@@ -0,0 +1,171 @@
+package database
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// TimeSheet is the part of an Employee that comes from Workday
+type TimeSheet struct {
+	International_Status string
+	Period_Punches       []PeriodPunches
+	Period_Blocks        []PeriodBlocks
+	Time_Blocks_Source   string
+	Fetched_At           time.Time
+}
+
+// TimeSheetFromEmployee copies the Workday data off of an employee that GetTimeSheet filled in
+func TimeSheetFromEmployee(employee *Employee) TimeSheet {
+	return TimeSheet{
+		International_Status: employee.International_Status,
+		Period_Punches:       slices.Clone(employee.Period_Punches),
+		Period_Blocks:        slices.Clone(employee.Period_Blocks),
+		Time_Blocks_Source:   employee.Time_Blocks_Source,
+		Fetched_At:           time.Now(),
+	}
+}
+
+// Apply puts the time sheet on employee and recalculates the hour totals for the current week and period
+func (t TimeSheet) Apply(employee *Employee) {
+	employee.International_Status = t.International_Status
+	employee.Period_Punches = append(employee.Period_Punches, t.Period_Punches...)
+	employee.Period_Blocks = append(employee.Period_Blocks, t.Period_Blocks...)
+	employee.Time_Blocks_Source = t.Time_Blocks_Source
+	CalculateHourTotals(employee)
+}
+
+// CacheState describes how a cached time sheet may be used
+type CacheState int
+
+const (
+	// CacheMiss means there is nothing usable in the cache
+	CacheMiss CacheState = iota
+	// CacheFresh means the time sheet is younger than the TTL and can be served as is
+	CacheFresh
+	// CacheRevalidate means the time sheet is past the TTL but can be served while it is refreshed in the background
+	CacheRevalidate
+	// CacheStale means the time sheet must be refetched, and should only be served if Workday can not be reached
+	CacheStale
+)
+
+type cacheEntry struct {
+	timeSheet    TimeSheet
+	invalidated  bool
+	revalidating bool
+}
+
+// TimeSheetCache holds recent Workday time sheets by worker ID.
+//
+// A time sheet is fresh for ttl. After that, for another revalidate it can still be served while a
+// new copy is fetched in the background. Past that, or once it has been invalidated by a punch, it
+// is only served (marked stale) if Workday is down, and is dropped entirely after maxStale.
+type TimeSheetCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	revalidate time.Duration
+	maxStale   time.Duration
+	entries    map[string]*cacheEntry
+	// now is time.Now, except in tests
+	now func() time.Time
+}
+
+// NewTimeSheetCache returns an empty TimeSheetCache. A ttl of 0 disables the cache.
+func NewTimeSheetCache(ttl, revalidate, maxStale time.Duration) *TimeSheetCache {
+	return &TimeSheetCache{
+		ttl:        ttl,
+		revalidate: revalidate,
+		maxStale:   maxStale,
+		entries:    make(map[string]*cacheEntry),
+		now:        time.Now,
+	}
+}
+
+// Get returns the cached time sheet for workerID and how it may be used. When CacheRevalidate is
+// returned the caller is responsible for refreshing the entry, and no other caller will be asked to.
+func (c *TimeSheetCache) Get(workerID string) (TimeSheet, CacheState) {
+	if c == nil || c.ttl <= 0 {
+		return TimeSheet{}, CacheMiss
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[workerID]
+	if !ok {
+		return TimeSheet{}, CacheMiss
+	}
+
+	age := c.now().Sub(entry.timeSheet.Fetched_At)
+	switch {
+	case age > c.maxStale:
+		delete(c.entries, workerID)
+		return TimeSheet{}, CacheMiss
+	case entry.invalidated:
+		return entry.timeSheet, CacheStale
+	case age <= c.ttl:
+		return entry.timeSheet, CacheFresh
+	case age <= c.ttl+c.revalidate && !entry.revalidating:
+		entry.revalidating = true
+		return entry.timeSheet, CacheRevalidate
+	case age <= c.ttl+c.revalidate:
+		// someone else is already refreshing it
+		return entry.timeSheet, CacheFresh
+	}
+	return entry.timeSheet, CacheStale
+}
+
+// Peek returns the time sheet cached for workerID without changing its state, as long as it hasn't been
+// invalidated by a punch or gotten older than maxStale. An invalidated time sheet may be missing punches
+// Workday has since picked up, so it is left for Get to serve as stale.
+func (c *TimeSheetCache) Peek(workerID string) (TimeSheet, bool) {
+	if c == nil || c.ttl <= 0 {
+		return TimeSheet{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[workerID]
+	if !ok || entry.invalidated || c.now().Sub(entry.timeSheet.Fetched_At) > c.maxStale {
+		return TimeSheet{}, false
+	}
+	return entry.timeSheet, true
+}
+
+// Put stores a freshly fetched time sheet
+func (c *TimeSheetCache) Put(workerID string, timeSheet TimeSheet) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[workerID] = &cacheEntry{timeSheet: timeSheet}
+}
+
+// RevalidateFailed lets another caller try to refresh the entry after a background refresh failed
+func (c *TimeSheetCache) RevalidateFailed(workerID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[workerID]; ok {
+		entry.revalidating = false
+	}
+}
+
+// Invalidate forces the next Get for workerID to refetch from Workday. The old time sheet is kept
+// so it can still be served as stale if Workday is down.
+func (c *TimeSheetCache) Invalidate(workerID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[workerID]; ok {
+		entry.invalidated = true
+	}
+}
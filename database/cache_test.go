@@ -0,0 +1,124 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+var cacheStart = time.Date(2024, 3, 12, 8, 0, 0, 0, time.UTC)
+
+// a cache holding one time sheet fetched at cacheStart, and the clock it reads
+func testCache() (*TimeSheetCache, *time.Time) {
+	now := cacheStart
+	c := NewTimeSheetCache(5*time.Minute, 10*time.Minute, 24*time.Hour)
+	c.now = func() time.Time { return now }
+	c.Put("123456789", TimeSheet{International_Status: "false", Fetched_At: cacheStart})
+	return c, &now
+}
+
+func TestTimeSheetCacheGet(t *testing.T) {
+	tests := []struct {
+		name        string
+		age         time.Duration
+		invalidated bool
+		want        CacheState
+	}{
+		{name: "fresh", age: time.Minute, want: CacheFresh},
+		{name: "at the ttl", age: 5 * time.Minute, want: CacheFresh},
+		{name: "revalidate", age: 6 * time.Minute, want: CacheRevalidate},
+		{name: "stale", age: 16 * time.Minute, want: CacheStale},
+		{name: "invalidated", age: time.Minute, invalidated: true, want: CacheStale},
+		{name: "past max stale", age: 25 * time.Hour, want: CacheMiss},
+		{name: "invalidated past max stale", age: 25 * time.Hour, invalidated: true, want: CacheMiss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, now := testCache()
+			if tt.invalidated {
+				c.Invalidate("123456789")
+			}
+			*now = cacheStart.Add(tt.age)
+
+			timeSheet, state := c.Get("123456789")
+			if state != tt.want {
+				t.Fatalf("Get() state = %d, want %d", state, tt.want)
+			}
+			if state != CacheMiss && timeSheet.International_Status != "false" {
+				t.Errorf("Get() = %+v, want the cached time sheet", timeSheet)
+			}
+		})
+	}
+}
+
+func TestTimeSheetCacheMiss(t *testing.T) {
+	c, _ := testCache()
+	if _, state := c.Get("987654321"); state != CacheMiss {
+		t.Errorf("Get() of an uncached worker = %d, want CacheMiss", state)
+	}
+
+	disabled := NewTimeSheetCache(0, time.Minute, time.Hour)
+	disabled.Put("123456789", TimeSheet{Fetched_At: time.Now()})
+	if _, state := disabled.Get("123456789"); state != CacheMiss {
+		t.Errorf("Get() with a ttl of 0 = %d, want CacheMiss", state)
+	}
+}
+
+func TestTimeSheetCacheRevalidateOnce(t *testing.T) {
+	c, now := testCache()
+	*now = cacheStart.Add(6 * time.Minute)
+
+	if _, state := c.Get("123456789"); state != CacheRevalidate {
+		t.Fatalf("first Get() = %d, want CacheRevalidate", state)
+	}
+	// only the first caller refreshes it
+	if _, state := c.Get("123456789"); state != CacheFresh {
+		t.Errorf("second Get() = %d, want CacheFresh", state)
+	}
+	c.RevalidateFailed("123456789")
+	if _, state := c.Get("123456789"); state != CacheRevalidate {
+		t.Errorf("Get() after a failed refresh = %d, want CacheRevalidate", state)
+	}
+	c.Put("123456789", TimeSheet{Fetched_At: *now})
+	if _, state := c.Get("123456789"); state != CacheFresh {
+		t.Errorf("Get() after a refresh = %d, want CacheFresh", state)
+	}
+}
+
+func TestTimeSheetCacheInvalidate(t *testing.T) {
+	c, now := testCache()
+	c.Invalidate("123456789")
+
+	// the time sheet is kept so it can be served if Workday is down, but not to check punches against
+	if timeSheet, ok := c.Peek("123456789"); ok {
+		t.Errorf("Peek() after Invalidate = %+v, want nothing", timeSheet)
+	}
+	if _, state := c.Get("123456789"); state != CacheStale {
+		t.Errorf("Get() after Invalidate = %d, want CacheStale", state)
+	}
+
+	// a new copy from Workday clears it
+	c.Put("123456789", TimeSheet{Fetched_At: *now})
+	if _, state := c.Get("123456789"); state != CacheFresh {
+		t.Errorf("Get() after Put = %d, want CacheFresh", state)
+	}
+}
+
+func TestTimeSheetCacheMaxStale(t *testing.T) {
+	c, now := testCache()
+	*now = cacheStart.Add(24 * time.Hour)
+	if _, state := c.Get("123456789"); state != CacheStale {
+		t.Errorf("Get() at max stale = %d, want CacheStale", state)
+	}
+
+	if _, ok := c.Peek("123456789"); !ok {
+		t.Error("Peek() at max stale found nothing, want the time sheet")
+	}
+
+	*now = cacheStart.Add(24*time.Hour + time.Second)
+	if _, ok := c.Peek("123456789"); ok {
+		t.Error("Peek() found the time sheet past max stale")
+	}
+	if _, state := c.Get("123456789"); state != CacheMiss {
+		t.Errorf("Get() past max stale = %d, want CacheMiss", state)
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// where the time blocks on an employee came from
+const (
+	TimeBlocksFromReport     = "INT265_Timeclocks"
+	TimeBlocksFromWebService = "Get_Calculated_Time_Blocks"
+	TimeBlocksFromFixture    = "fixture"
+)
+
+// TimeBlocksSource gets time blocks from the Get_Calculated_Time_Blocks web service. It has no time
+// events or international status.
+type TimeBlocksSource struct{}
+
+// Blocks Workday sent without all of their data are skipped. If a page can't be gotten the blocks from
+// the pages before it are returned with the error.
+func (TimeBlocksSource) TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (TimeData, error) {
+	data := TimeData{Time_Blocks_Source: TimeBlocksFromWebService}
+	timeBlocks := make(map[string]workday.WorkerTimeBlockInfo)
+	var skipped error
+	err := workday.GetCalculatedTimeBlocks(ctx, workday.TimeBlocksRequest{
+		Worker_IDs: []string{workerID},
+		Start_Date: start.Format(time.DateOnly),
+		End_Date:   end.Format(time.DateOnly),
+	}, func(page int, body []byte) error {
+		_, err := workday.SortCalculatedTimeBlocks(timeBlocks, body)
+		skipped = errors.Join(skipped, err)
+		return nil
+	})
+	data.Time_Blocks = TimeBlocksFromCalculated(timeBlocks)
+	if err != nil {
+		return data, err
+	}
+	if skipped != nil {
+		if len(timeBlocks) == 0 {
+			return data, skipped
+		}
+		// the rest of the blocks are still worth showing
+		slog.Warn("skipped some calculated time blocks", "worker_id", workerID, "error", skipped)
+	}
+	return data, nil
+}
+
+// TimeBlocksFromCalculated converts calculated time blocks by reference ID to TimeBlocks ordered by in time
+func TimeBlocksFromCalculated(timeBlocks map[string]workday.WorkerTimeBlockInfo) []TimeBlock {
+	var blocks []TimeBlock
+	for referenceID, block := range timeBlocks {
+		blocks = append(blocks, TimeBlock{
+			Reference_ID: referenceID,
+			Position:     block.Position_ID,
+			In_Time:      block.In_Time,
+			Out_Time:     block.Out_Time,
+			Hours:        block.Calculated_Quantity,
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].In_Time != blocks[j].In_Time {
+			return blocks[i].In_Time < blocks[j].In_Time
+		}
+		return blocks[i].Reference_ID < blocks[j].Reference_ID
+	})
+	return blocks
+}
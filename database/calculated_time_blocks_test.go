@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// page, total pages, block ID, status
+const calculatedTimeBlocksPage = `<Envelope><Body><Get_Calculated_Time_Blocks_Response>
+<Response_Results><Total_Pages>%[2]d</Total_Pages><Page_Results>1</Page_Results><Page>%[1]d</Page></Response_Results>
+<Response_Data><Calculated_Time_Block>
+    <Worker_Time_Block_Reference><ID type="WID">wid</ID><ID type="Calculated_Time_Block_ID">%[3]s</ID></Worker_Time_Block_Reference>
+    <Calculated_Time_Block_Data>
+        <Worker_Reference><ID type="Employee_ID">123456789</ID></Worker_Reference>
+        <Position_Reference><ID type="Position_ID">P1</ID></Position_Reference>
+        <In_Time>2024-03-1%[1]dT08:00:00-06:00</In_Time>
+        <Out_Time>2024-03-1%[1]dT12:00:00-06:00</Out_Time>
+        <Calculated_Quantity>4</Calculated_Quantity>
+        %[4]s
+        <Calculation_Tag_Reference><ID type="Time_Calculation_Tag_ID">Regular</ID></Calculation_Tag_Reference>
+    </Calculated_Time_Block_Data>
+</Calculated_Time_Block></Response_Data>
+</Get_Calculated_Time_Blocks_Response></Body></Envelope>`
+
+const approved = `<Status_Reference><ID type="Time_Tracking_Set_Up_Option_ID">Approved</ID></Status_Reference>`
+
+const serverFault = `<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/"><SOAP-ENV:Body>
+<SOAP-ENV:Fault><faultcode>SOAP-ENV:Server.processingError</faultcode><faultstring>An unexpected error occurred</faultstring></SOAP-ENV:Fault>
+</SOAP-ENV:Body></SOAP-ENV:Envelope>`
+
+// points the workday package at a server that calls page for each page requested
+func calculatedTimeBlocksServer(t *testing.T, page func(w http.ResponseWriter, page int)) {
+	t.Helper()
+	pagePattern := regexp.MustCompile(`<bsvc:Page>(\d+)</bsvc:Page>`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		n, _ := strconv.Atoi(pagePattern.FindStringSubmatch(string(body))[1])
+		page(w, n)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("WORKDAY_API_URL", server.URL)
+	t.Setenv("WORKDAY_API_TENANT", "byu")
+	t.Setenv("WORKDAY_API_USER", "ISU_INT265")
+	t.Setenv("WORKDAY_API_PASSWORD", "password")
+	err := workday.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeBlocksSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       func(w http.ResponseWriter, page int)
+		wantBlocks []string
+		wantErr    bool
+		wantKind   error
+	}{
+		{
+			name: "every page",
+			page: func(w http.ResponseWriter, page int) {
+				fmt.Fprintf(w, calculatedTimeBlocksPage, page, 2, fmt.Sprintf("block-%d", page), approved)
+			},
+			wantBlocks: []string{"block-1", "block-2"},
+		},
+		{
+			name: "a block without a status",
+			page: func(w http.ResponseWriter, page int) {
+				status := approved
+				if page == 2 {
+					status = ""
+				}
+				fmt.Fprintf(w, calculatedTimeBlocksPage, page, 3, fmt.Sprintf("block-%d", page), status)
+			},
+			wantBlocks: []string{"block-1", "block-3"},
+		},
+		{
+			name: "fault on page 2",
+			page: func(w http.ResponseWriter, page int) {
+				if page == 2 {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, serverFault)
+					return
+				}
+				fmt.Fprintf(w, calculatedTimeBlocksPage, page, 3, fmt.Sprintf("block-%d", page), approved)
+			},
+			wantBlocks: []string{"block-1"},
+			wantErr:    true,
+			wantKind:   workday.ErrServer,
+		},
+		{
+			name: "connection lost on page 2",
+			page: func(w http.ResponseWriter, page int) {
+				if page == 2 {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				fmt.Fprintf(w, calculatedTimeBlocksPage, page, 3, fmt.Sprintf("block-%d", page), approved)
+			},
+			wantBlocks: []string{"block-1"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calculatedTimeBlocksServer(t, tt.page)
+
+			start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			data, err := TimeBlocksSource{}.TimeData(context.Background(), "123456789", start, start.AddDate(0, 0, 14))
+			if (err != nil) != tt.wantErr || (tt.wantKind != nil && !errors.Is(err, tt.wantKind)) {
+				t.Errorf("TimeData() error = %v, want error %t of kind %v", err, tt.wantErr, tt.wantKind)
+			}
+
+			var got []string
+			for _, block := range data.Time_Blocks {
+				got = append(got, block.Reference_ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantBlocks) {
+				t.Errorf("got blocks %v, want %v", got, tt.wantBlocks)
+			}
+			if data.Time_Blocks_Source != TimeBlocksFromWebService {
+				t.Errorf("got source %q, want %q", data.Time_Blocks_Source, TimeBlocksFromWebService)
+			}
+		})
+	}
+}
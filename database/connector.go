@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+const database_timeout = "5"
+
+// where the TCD is. The password can change while the server runs when it comes from a file.
+type tcdSettings struct {
+	host     string
+	port     string
+	user     string
+	dbname   string
+	password atomic.Pointer[string]
+}
+
+func (s *tcdSettings) dsn() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require connect_timeout=%s",
+		quoteDSN(s.host), quoteDSN(s.port), quoteDSN(s.user), quoteDSN(*s.password.Load()), quoteDSN(s.dbname), database_timeout)
+}
+
+// quotes a value for a lib/pq connection string, so passwords with spaces or quotes work
+func quoteDSN(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// tcdConnector opens each new TCD connection with the current password, so a rotated password is used
+// without restarting. Connections that are already open keep working until they are closed.
+type tcdConnector struct {
+	settings *tcdSettings
+}
+
+func (c *tcdConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	connector, err := pq.NewConnector(c.settings.dsn())
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *tcdConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
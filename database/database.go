@@ -1,19 +1,19 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"slices"
 	"strconv"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/byuoitav/workday-pi-time/config"
+	"github.com/byuoitav/workday-pi-time/paycalendar"
 )
 
 type Punch struct {
@@ -23,13 +23,22 @@ type Punch struct {
 	Time_Entry_Code            string    `json:"time_entry_code"`
 	Comment                    string    `json:"comment"`
 	Time_Clock_Event_Date_Time time.Time `json:"time_clock_event_date_time"`
+	// Received_At is when the timeclock's server got the punch, kept alongside the punch time for auditing
+	Received_At time.Time `json:"received_at"`
+	// Punch_ID is an optional UUID from the kiosk, so a retried punch is only recorded once
+	Punch_ID string `json:"punch_id,omitempty"`
+	// Confirm is set when the worker has been warned the punch contradicts their clock state and wants it anyway
+	Confirm bool `json:"confirm,omitempty"`
 }
 
 type PunchResponse struct {
-	Writen_To_TCD    string `json:"written_to_tcd"`
-	Punch_Time       string `json:"punch_time"`
-	Clock_Event_Type string `json:"clock_event_type"`
-	Hostname         string `json:"hostname"`
+	Writen_To_TCD string `json:"written_to_tcd"`
+	Queued        string `json:"queued"`
+	// Workday_Reference_ID is set when the punch was sent straight to Workday instead of the TCD
+	Workday_Reference_ID string `json:"workday_reference_id,omitempty"`
+	Punch_Time           string `json:"punch_time"`
+	Clock_Event_Type     string `json:"clock_event_type"`
+	Hostname             string `json:"hostname"`
 }
 
 type Employee struct {
@@ -44,6 +53,8 @@ type Employee struct {
 	Period_Punches       []PeriodPunches   `json:"period_punches"`
 	Period_Blocks        []PeriodBlocks    `json:"period_blocks"`
 	TimeCodeNameLookup   map[string]string `json:"-"`
+	// Time_Blocks_Source is TimeBlocksFromReport or TimeBlocksFromWebService
+	Time_Blocks_Source string `json:"-"`
 }
 
 type TimeEntryCodes struct {
@@ -60,6 +71,10 @@ type Position struct {
 	Position_Total_Week_Hours   string `json:"position_total_week_hours"`
 	Position_Total_Period_Hours string `json:"position_total_period_hours"`
 	Clocked_In                  string `json:"clocked_in"`
+	// one of clocked-in, clocked-out, missing-out or double-in
+	Clock_State string `json:"clock_state"`
+	// time of the IN that is still open, empty when clocked out
+	Clocked_In_Since string `json:"clocked_in_since,omitempty"`
 }
 
 // Punches not related to a time block
@@ -83,54 +98,6 @@ type PeriodBlocks struct {
 	Time_Entry_Code_Ref_ID_Name        string `json:"time_entry_code_ref_id_name,omitempty"`
 }
 
-// JSON from new workday custom API
-type WorkdayTimeBlocksReport struct {
-	Report_Entry []WorkdayTimeBlock `json:"Report_Entry"`
-}
-
-type WorkdayTimeBlock struct {
-	Worker_ID                          string `json:"employee_id"`
-	Time_Code_Groups                   string `json:"time_code_group"`
-	International_Status               string `json:"intl_student"`
-	In_Time                            string `json:"in_time,omitempty"`
-	Out_Time                           string `json:"out_time,omitempty"`
-	Position                           string `json:"position"`
-	Time_Type                          string `json:"time_type,omitempty"`
-	Hours                              string `json:"hours"`
-	Reference_ID                       string `json:"reference_id,omitempty"`
-	Time_Entry_Code_Ref_ID_from_Source string `json:"Time_Entry_Code_Ref_ID_from_Source,omitempty"`
-}
-
-// JSON from old workday custom API
-type WorkdayEmployeeTimeReport struct {
-	Report_Entry []WorkdayWorkerTimeData `json:"Report_Entry"`
-}
-
-type WorkdayWorkerTimeData struct {
-	Worker_ID            string              `json:"employee_id"`
-	Time_Code_Groups     string              `json:"time_code_group"`
-	International_Status string              `json:"intl_student"`
-	Time_Blocks          []WorkdayTimeBlocks `json:"time_blocks"`
-	Time_Clock_Events    []WorkdayTimeEvents `json:"time_clock_events"`
-}
-
-type WorkdayTimeEvents struct {
-	Clock_Event_Time string `json:"time"`             //`json:"clock_event_time"`
-	Clock_Event_Type string `json:"event_type"`       //`json:"clock_event_type"`
-	Position_Ref_ID  string `json:"tce_position"`     //`json:"position_ref_id"`
-	Timeblock_Ref_ID string `json:"timeblock_ref_id"` //`json:"timeblock_ref_id"`
-}
-
-type WorkdayTimeBlocks struct {
-	Reported_Date string `json:"reported_date"`
-	Hours         string `json:"hours"`
-	Time_Type     string `json:"time_type"`
-	Reference_ID  string `json:"reference_id"`
-	Position      string `json:"position"`
-	In_Time       string `json:"in_time"`
-	Out_Time      string `json:"out_time"`
-}
-
 type TCD_Employee struct {
 	Worker_ID       string `json:"employee_id"`
 	BYU_ID          string `json:"byu_id"`
@@ -142,121 +109,103 @@ type TCD_Employee struct {
 
 var db *sql.DB
 
-const database_timeout = "5"
-
-var apiPassword, apiUser, tokenRefreshURL, apiURL, apiTenant string
-var payPeriodAnchorDate time.Time
-
-func init() {
-	var err error
-	slog.Info("getting environment variables for databaseIO package")
-	var (
-		host     = os.Getenv("WORKDAY_DB_HOST")
-		user     = os.Getenv("WORKDAY_DB_USER")
-		password = os.Getenv("WORKDAY_DB_PASSWORD")
-		dbname   = os.Getenv("WORKDAY_DB_NAME")
-	)
-	port, err := strconv.Atoi(os.Getenv("WORKDAY_DB_PORT"))
-	if err != nil {
-		panic("WORKDAY_DB_PORT is not an int")
-	}
-	if host == "" || port == 0 || user == "" || password == "" || dbname == "" {
-		slog.Info("error getting environment variables, exiting")
-		os.Exit(1)
-	}
+// where the custom reports are - the credentials for them come from the workday package
+var apiURL, apiTenant string
 
-	// setup database connection
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=require connect_timeout=%s",
-		host, port, user, password, dbname, database_timeout)
-
-	db, err = sql.Open("postgres", psqlInfo)
-	if err != nil {
-		slog.Error("error opening database:", "err", err)
-		os.Exit(1)
-	}
-	getGlobalVars()
+// how long a single call to each dependency may take - set with TCD_TIMEOUT and WORKDAY_TIMEOUT
+var tcdTimeout, workdayTimeout = 5 * time.Second, 10 * time.Second
 
-	//date to establish the pay period cadence
-	anchorDate := "2023-Dec-09"
-	loc, _ := time.LoadLocation("America/Denver")
-	payPeriodAnchorDate, err = time.ParseInLocation("2006-Jan-02", anchorDate, loc)
-	if err != nil {
-		slog.Error(err.Error())
-		panic(err)
-	}
-	slog.Info("Started database.go with database variables:", "host", host, "port", port, "user", user, "password", "********", "dbname", dbname)
-	slog.Info("Started database.go with global variables:", "tokenRefreshURL", tokenRefreshURL, "apiURL", apiURL, "apiUser", apiUser, "apiPassword", "********", "apiTenant", apiTenant)
-}
+// how many days of time data are shown before today - set with WORKDAY_LOOK_BACK_DAYS
+var lookBackDays = 31
 
-func getGlobalVars() {
-	tokenRefreshURL = os.Getenv("BDP_TOKEN_REFRESH_URL")
-	apiUser = os.Getenv("WORKDAY_API_USER")
-	apiPassword = os.Getenv("WORKDAY_API_PASSWORD")
-	apiURL = os.Getenv("WORKDAY_API_URL")
-	apiTenant = os.Getenv("WORKDAY_API_TENANT")
-	if tokenRefreshURL == "" || apiUser == "" || apiPassword == "" || apiURL == "" || apiTenant == "" {
-		slog.Error(`bdp package error
-		error getting environment variables. 
-		BDP_TOKEN_REFRESH_URL, WORKDAY_API_USER, WORKDAY_API_PASSWORD, WORKDAY_API_URL, WORKDAY_API_TENANT must be set to valid values. 
-		exiting`)
-		os.Exit(1)
-	}
-}
+var workdayClient = &http.Client{Timeout: workdayTimeout}
 
-func DatabaseIO(query string) (*sql.Rows, error) {
-	slog.Debug("Stats", "DatabaseOpenConnections", db.Stats().OpenConnections)
-	var data *sql.Rows
-	var err error
-	slog.Debug("attempting database query", "query", query)
+// the pay calendar the hour totals are based on, from PAY_CALENDAR / PAY_* and the TCD
+var payCalendar atomic.Pointer[paycalendar.Calendar]
+var payCalendarConfig paycalendar.Config
 
-	data, err = db.Query(query)
-	if err != nil {
-		return data, fmt.Errorf("error inserting into database with string:\n%s\n error: %w", query, err)
-	}
+// how often the pay period overrides are loaded from the TCD - set with PAY_CALENDAR_REFRESH_INTERVAL.
+// After a failure they are tried again sooner, backing off from payCalendarRetry up to the refresh interval.
+var payCalendarRefresh, payCalendarRetry = 6 * time.Hour, 30 * time.Second
 
-	slog.Debug("database query successful", "Data", data)
-	return data, nil
+// SetPayCalendar changes the pay calendar the hour totals are based on
+func SetPayCalendar(calendar *paycalendar.Calendar) {
+	payCalendar.Store(calendar)
 }
 
-// get all punches fopr a given worker_id from the TCD
-const getPunchesQuery = `SELECT employee_id, clock_event_type, time_entry_code, comment, time_clock_event_date_time, position_id 
-FROM workday.timeevents WHERE employee_id = '%s' AND uploaded_to_workday_date_time IS NULL AND failed_to_upload IS false;`
+// Setup reads the TCD and Workday report settings and connects to the TCD, returning everything wrong with
+// the settings at once. A WORKDAY_DB_PASSWORD_FILE is reloaded when it changes.
+func Setup() error {
+	var l config.Loader
+	settings := tcdSettings{
+		host:   l.Required("WORKDAY_DB_HOST"),
+		port:   l.Required("WORKDAY_DB_PORT"),
+		user:   l.Required("WORKDAY_DB_USER"),
+		dbname: l.Required("WORKDAY_DB_NAME"),
+	}
+	if _, err := strconv.Atoi(settings.port); settings.port != "" && err != nil {
+		l.Problem(fmt.Errorf("WORKDAY_DB_PORT must be a number, not %q", settings.port))
+	}
+	password := l.Required("WORKDAY_DB_PASSWORD")
+
+	apiURL = l.Required("WORKDAY_API_URL")
+	apiTenant = l.Required("WORKDAY_API_TENANT")
+	tcdTimeout = l.Duration("TCD_TIMEOUT", 5*time.Second)
+	workdayTimeout = l.Duration("WORKDAY_TIMEOUT", 10*time.Second)
+	workdayClient.Timeout = workdayTimeout
+	lookBackDays = l.Int("WORKDAY_LOOK_BACK_DAYS", 31)
+	payCalendarRefresh = l.Duration("PAY_CALENDAR_REFRESH_INTERVAL", 6*time.Hour)
+
+	//pay schedule used to establish the pay period cadence
+	cfg := paycalendar.LoadConfig(&l)
+	calendar, err := paycalendar.New(cfg)
+	if err != nil {
+		l.Problem(err)
+	}
 
-func GetEmployeePunchesInTCD(workerID string) ([]Punch, error) {
-	var punches []Punch
-	var err error
+	source := LoadTimeDataSource(&l)
 
-	query := fmt.Sprintf(getPunchesQuery, workerID)
-	slog.Debug("sending database query", "Query", query)
-	data, err := DatabaseIO(query)
+	err = l.Err()
 	if err != nil {
-		return punches, fmt.Errorf("error calling DatabaseQuery function %w", err)
-	}
-	defer data.Close()
-	for data.Next() {
-		var row Punch
-		err := data.Scan(&row.Worker_ID, &row.Clock_Event_Type, &row.Time_Entry_Code, &row.Comment, &row.Time_Clock_Event_Date_Time, &row.Position_Number)
-		if err != nil {
-			slog.Error("can not scan the returned data", "error", err, "data", data)
-			return punches, err
-		}
-		punches = append(punches, row)
+		return err
 	}
+	timeDataSource = source
+	payCalendarConfig = cfg
+	payCalendar.Store(calendar)
 
-	return punches, err
+	// setup database connection
+	settings.password.Store(&password)
+	db = sql.OpenDB(&tcdConnector{settings: &settings})
+	config.Watch("WORKDAY_DB_PASSWORD", func(password string) {
+		settings.password.Store(&password)
+	})
+
+	slog.Info("Started database.go with database variables:", "host", settings.host, "port", settings.port, "user", settings.user, "password", "********", "dbname", settings.dbname)
+	slog.Info("Started database.go with global variables:", "apiURL", apiURL, "apiTenant", apiTenant)
+	slog.Info("Started database.go with timeouts:", "tcdTimeout", tcdTimeout, "workdayTimeout", workdayTimeout)
+	slog.Info("Started database.go with time data:", "source", fmt.Sprintf("%T", timeDataSource), "lookBackDays", lookBackDays)
+	return nil
 }
 
-func GetRecentEmployeePunches(employee *Employee) (int, error) {
-	var err error
-	var count int
+func GetRecentEmployeePunches(ctx context.Context, store TCDStore, employee *Employee) (int, error) {
 	if employee.Worker_ID == "" {
-		err = fmt.Errorf("must have employee.Worker_ID defined before calling GetRecentEmployeePunches")
-		return count, err
+		return 0, fmt.Errorf("must have employee.Worker_ID defined before calling GetRecentEmployeePunches")
 	}
-	punches, err := GetEmployeePunchesInTCD(employee.Worker_ID)
+	periodPunches, err := GetPendingPeriodPunches(ctx, store, employee.Worker_ID, employee.Positions)
+	if err != nil {
+		return 0, err
+	}
+	employee.Period_Punches = append(employee.Period_Punches, periodPunches...)
+	return len(periodPunches), nil
+}
+
+// returns the punches in the TCD that have not been uploaded to Workday as PeriodPunches.
+// positions is only read, so this is safe to call while something else fills in the rest of the employee.
+func GetPendingPeriodPunches(ctx context.Context, store TCDStore, workerID string, positions []Position) ([]PeriodPunches, error) {
+	var periodPunches []PeriodPunches
+	punches, err := store.PendingPunches(ctx, workerID)
 	if err != nil {
-		return count, err
+		return periodPunches, err
 	}
 
 	for _, v := range punches {
@@ -268,7 +217,7 @@ func GetRecentEmployeePunches(employee *Employee) (int, error) {
 
 		livePunch.Position_Number = v.Position_Number
 
-		for _, position := range employee.Positions {
+		for _, position := range positions {
 			if position.Position_Number == v.Position_Number {
 				livePunch.Business_Title = position.Business_Title
 			}
@@ -280,83 +229,34 @@ func GetRecentEmployeePunches(employee *Employee) (int, error) {
 			livePunch.Clock_Event_Type = "Check-out"
 		}
 
-		employee.Period_Punches = append(employee.Period_Punches, livePunch)
-		count++
+		periodPunches = append(periodPunches, livePunch)
 	}
-	return count, err
+	return periodPunches, nil
 }
 
-// write a single punch to the postgres database - called form each individual pi on a punch event
-const insertPunchQuery = `INSERT INTO workday.timeevents(employee_id, position_id, clock_event_type, time_entry_code, "comment", time_clock_event_date_time, pi_hostname)
-VALUES('%s', '%s', '%s', '%s', '%s', '%s', '%s');`
-
-func WritePunch(punch Punch) (PunchResponse, error) {
-	var punchResponse PunchResponse
-	hostname, err := os.Hostname()
-	if err != nil {
-		return punchResponse, fmt.Errorf("error gettng hostname: %w", err)
-	}
-	dateTime := time.Now()
-	formattedDateTime := dateTime.Format(time.RFC1123Z) // formats to this style for postgres and workday: "02 Jan 06 15:04 -0700"
-
-	query := fmt.Sprintf(insertPunchQuery, punch.Worker_ID, punch.Position_Number, punch.Clock_Event_Type, punch.Time_Entry_Code, punch.Comment, formattedDateTime, hostname)
-	slog.Debug("sending database query", "Query", query)
-	data, err := DatabaseIO(query)
-	if err != nil {
-		return punchResponse, fmt.Errorf("error calling DatabaseQuery function %w", err)
-	}
-	defer data.Close()
-	punchResponse.Punch_Time = formattedDateTime
-	punchResponse.Clock_Event_Type = punch.Clock_Event_Type
-	punchResponse.Writen_To_TCD = "true"
-	return punchResponse, nil
-}
-
-// receives list of time codes, queries the database and returns a time code struct with data from the database table
-const getTimeCodesQery = `SELECT time_code_groups, time_entry_code, entry_method, time_code_reference_id, ui_name, sort_order FROM workday.time_entry_code_map WHERE ui_name is not null ;`
-
-func MapTimeCodes(timeCodes []string) ([]TimeEntryCodes, map[string]string, error) {
-	type databaseInfo struct {
-		time_code_groups       string
-		time_entry_code        string
-		entry_method           string
-		time_code_reference_id string
-		ui_name                string
-		sort_order             int
-	}
-	data, err := DatabaseIO(getTimeCodesQery)
+// returns the time codes for the given time code groups and a lookup of time_code_reference_id : ui_name
+func MapTimeCodes(ctx context.Context, store TCDStore, timeCodes []string) ([]TimeEntryCodes, map[string]string, error) {
 	var toReturn []TimeEntryCodes
 	lookupMap := make(map[string]string)
 
-	var fromDatabase []databaseInfo
+	fromDatabase, err := store.TimeCodeMap(ctx)
 	if err != nil {
-		return toReturn, nil, fmt.Errorf("error calling DatabaseQuery function %w", err)
-	}
-	defer data.Close()
-
-	for data.Next() {
-		var row databaseInfo
-		err := data.Scan(&row.time_code_groups, &row.time_entry_code, &row.entry_method, &row.time_code_reference_id, &row.ui_name, &row.sort_order)
-		if err != nil {
-			return toReturn, nil, err
-		}
-		fromDatabase = append(fromDatabase, row)
+		return toReturn, nil, err
 	}
 
 	//loop and organize fromDatabase as a map of: "time_code_groups : ui_name" AND "time_code_groups : time_code_reference_id"
 	for _, v := range fromDatabase {
-		lookupMap[v.time_code_reference_id] = v.ui_name
-		if slices.Contains(timeCodes, v.time_code_groups) && v.ui_name != "" {
-			//if slices.Contains(timeCodes, v.time_code_groups) {
+		lookupMap[v.Time_Code_Reference_ID] = v.UI_Name
+		if slices.Contains(timeCodes, v.Time_Code_Groups) && v.UI_Name != "" {
 			var timeEntryCode TimeEntryCodes
-			timeEntryCode.Backend_ID = v.time_code_reference_id
-			timeEntryCode.Display_Name = v.ui_name
-			timeEntryCode.Sort_Order = v.sort_order
+			timeEntryCode.Backend_ID = v.Time_Code_Reference_ID
+			timeEntryCode.Display_Name = v.UI_Name
+			timeEntryCode.Sort_Order = v.Sort_Order
 
 			//make sure only one time code is in the list with the same frontend_name and add to return slice if it doesn't already exist
 			exists := false
 			for _, code := range toReturn {
-				if code.Display_Name == v.ui_name {
+				if code.Display_Name == v.UI_Name {
 					exists = true
 				}
 			}
@@ -369,26 +269,10 @@ func MapTimeCodes(timeCodes []string) ([]TimeEntryCodes, map[string]string, erro
 	return toReturn, lookupMap, nil
 }
 
-const getWorkerQuery = `SELECT worker_id, byu_id, last_updated, employee_name, time_code_group, positions FROM workday.employee_cache WHERE worker_id = '%s';`
-
-func GetWorkerInfo(byuid string, employee *Employee) error {
-	query := fmt.Sprintf(getWorkerQuery, byuid)
-	data, err := DatabaseIO(query)
+func GetWorkerInfo(ctx context.Context, store TCDStore, byuid string, employee *Employee) error {
+	emp, err := store.GetWorker(ctx, byuid)
 	if err != nil {
-		return fmt.Errorf("error calling DatabaseQuery function on employee_cache database %w", err)
-	}
-	defer data.Close()
-
-	var emp TCD_Employee
-	for data.Next() {
-
-		err := data.Scan(&emp.Worker_ID, &emp.BYU_ID, &emp.Last_Updated, &emp.Employee_Name, &emp.Time_Code_Group, &emp.Positions)
-		if err != nil {
-			return err
-		}
-	}
-	if emp.Worker_ID == "" {
-		return fmt.Errorf("no worker at byuID from employee_cache database: %s", byuid)
+		return err
 	}
 	employee.Employee_Name = emp.Employee_Name
 	employee.Worker_ID = emp.Worker_ID
@@ -403,7 +287,7 @@ func GetWorkerInfo(byuid string, employee *Employee) error {
 	var timeCodeNameLookup map[string]string
 
 	//create time code map to put on employee.Time_Entey_Codes
-	employee.Time_Entry_Codes, timeCodeNameLookup, err = MapTimeCodes(timeCodeGroupList)
+	employee.Time_Entry_Codes, timeCodeNameLookup, err = MapTimeCodes(ctx, store, timeCodeGroupList)
 	if err != nil {
 		return fmt.Errorf("could not get the time_entry_code_map from employee_cache database. error: %w", err)
 	}
@@ -441,139 +325,80 @@ func GetWorkerInfo(byuid string, employee *Employee) error {
 }
 
 // ------------------------------------------------------------------------------------------------------Workday custom API start------------------------------------------------------------
-// gets time data from workday custom API
-func GetTimeSheet(byuID string, employeeData *Employee) error {
+// gets a worker's time data for the last lookBackDays from timeDataSource and maps it onto employeeData. If only
+// part of it could be gotten that part is still mapped, and the error for the rest is returned.
+func GetTimeSheet(ctx context.Context, byuID string, employeeData *Employee) error {
 	slog.Debug("start GetTimeGroups")
-	var workerTimeData WorkdayEmployeeTimeReport
-	var workerTimeBlocks WorkdayTimeBlocksReport
-	var err error
-
 	today := time.Now()
 	today = today.AddDate(0, 0, 1)
-	lastMonth := today.AddDate(0, -1, 0)
-
-	//Get First API Data - used to get time events and international status
-	url := apiURL + "/ccx/service/customreport2/" + apiTenant + "/ISU_INT265/INT265_Timekeeping_System?employee_id=" + byuID + "&start_date=" +
-		lastMonth.Format(time.DateOnly) + "-00%3A00&end_date=" + today.Format(time.DateOnly) + "-00%3A00&format=json"
-	slog.Debug("making request to", "url", url)
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Authorization", "Basic "+basicAuth(apiUser, apiPassword))
-
-	response, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		return err
-	}
-
-	slog.Debug("attempting to unmarshall workerTimeData")
-	err = json.Unmarshal(body, &workerTimeData)
-	if err != nil {
-		slog.Error("error unmarshalling workerTimeData", "error", err)
-		return err
-	}
-	if len(workerTimeData.Report_Entry) < 1 {
-		return fmt.Errorf("employee not found in workday, empty slice")
-	}
-	if workerTimeData.Report_Entry[0].Worker_ID == "" {
-		return fmt.Errorf("no employee_id returned")
-	}
-
-	//Get Second API data - used to get time blocks
-	url = apiURL + "/ccx/service/customreport2/" + apiTenant + "/ISU_INT265/INT265_Timeclocks?employee_id=" + byuID + "&start_date=" +
-		lastMonth.Format(time.DateOnly) + "-00%3A00&end_date=" + today.Format(time.DateOnly) + "-00%3A00&format=json"
-	slog.Debug("making request to", "url", url)
-
-	//client := &http.Client{}
+	lookBack := today.AddDate(0, 0, -lookBackDays)
 
-	req, err = http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Authorization", "Basic "+basicAuth(apiUser, apiPassword))
-
-	response, err = client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
-	body, err = io.ReadAll(response.Body)
-	if err != nil {
-		return err
+	data, err := timeDataSource.TimeData(ctx, byuID, lookBack, today)
+	mapErr := MapEmployeeTimeData(employeeData, &data)
+	if mapErr != nil {
+		return mapErr
 	}
+	slog.Debug("end GetTimeGroups")
+	return err
+}
 
-	slog.Debug("attempting to unmarshall workerTimeData")
-	err = json.Unmarshal(body, &workerTimeBlocks)
+// LoadPayCalendarOverrides adds the pay period overrides stored in the TCD to the configured pay calendar
+func LoadPayCalendarOverrides(ctx context.Context, store TCDStore) error {
+	overrides, err := store.PayPeriodOverrides(ctx)
 	if err != nil {
-		slog.Error("error unmarshalling workerTimeData", "error", err)
-		return err
-	}
-	if workerTimeData.Report_Entry[0].Worker_ID == "" {
-		return fmt.Errorf("no employee_id returned")
+		return fmt.Errorf("unable to get pay period overrides from the TCD: %w", err)
 	}
 
-	err = MapEmployeeTimeData(employeeData, &workerTimeData.Report_Entry[0], &workerTimeBlocks)
+	cfg := payCalendarConfig
+	cfg.Overrides = append(slices.Clone(cfg.Overrides), overrides...)
+	calendar, err := paycalendar.New(cfg)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid pay period override in the TCD: %w", err)
 	}
-	slog.Debug("attempting to get international status")
-	err = GetInternationalStatus(employeeData, &workerTimeData.Report_Entry[0])
-	if err != nil {
-		return err
-	}
-	slog.Debug("end GetTimeGroups")
-
+	payCalendar.Store(calendar)
+	slog.Info("loaded pay period overrides from the TCD", "count", len(overrides))
 	return nil
 }
 
-func GetInternationalStatus(employee *Employee, worker *WorkdayWorkerTimeData) error {
-	var err error
-	if worker.International_Status == "1" {
-		employee.International_Status = "true"
-	} else {
-		employee.International_Status = "false"
+// RefreshPayCalendarOverrides loads the pay period overrides from the TCD, and again every
+// PAY_CALENDAR_REFRESH_INTERVAL in case they change, until ctx is done. If the TCD is down they are tried
+// again sooner so a clock that starts without the TCD picks them up once it is back.
+func RefreshPayCalendarOverrides(ctx context.Context, store TCDStore) {
+	retry := payCalendarRetry
+	for {
+		wait := payCalendarRefresh
+		err := LoadPayCalendarOverrides(ctx, store)
+		if err != nil {
+			slog.Warn("can not load pay period overrides", "error", err, "retry", retry)
+			wait = min(retry, payCalendarRefresh)
+			retry = min(retry*2, payCalendarRefresh)
+		} else {
+			retry = payCalendarRetry
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
-	return err
 }
 
-func ReturnCurrentPayPeriod() (start, end time.Time) {
-
-	today := time.Now() //.AddDate(0, 0, -7) //////////////////////////////////////Testing - need to remove the date shift
-	difference := today.Sub(payPeriodAnchorDate)
-	weeksSince := int(difference.Hours() / 24 / 7)
-	periodsSince := int((weeksSince / 2))
-
-	start = payPeriodAnchorDate.AddDate(0, 0, periodsSince*14)
-	end = start.AddDate(0, 0, 13)
-	end = end.Add(24*time.Hour - 1*time.Second)
-	slog.Info("return current pay period", "start", start, "end", end)
-	return
+func ReturnCurrentPayPeriod() paycalendar.Period {
+	period := payCalendar.Load().PeriodFor(time.Now())
+	slog.Info("return current pay period", "first_day", period.FirstDay(), "last_day", period.LastDay())
+	return period
 }
 
-func ReturnCurrentWeek() (time.Time, time.Time) {
-	var start, end time.Time
-	today := time.Now() //.AddDate(0, 0, -7) //////////////////////////////////////Testing - need to remove the date shift
-	difference := today.Sub(payPeriodAnchorDate)
-	weeksSince := int(difference.Hours() / 24 / 7)
-
-	start = payPeriodAnchorDate.AddDate(0, 0, weeksSince*7)
-	end = start.AddDate(0, 0, 6)
-	end = end.Add(24*time.Hour - 1*time.Second)
-	slog.Info("return current week", "start", start, "end", end)
-
-	return start, end
+func ReturnCurrentWeek() paycalendar.Period {
+	week := payCalendar.Load().WeekFor(time.Now())
+	slog.Info("return current week", "first_day", week.FirstDay(), "last_day", week.LastDay())
+	return week
 }
 
-func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, workerTimeBlocks *WorkdayTimeBlocksReport) (err error) {
+func MapEmployeeTimeData(employee *Employee, data *TimeData) (err error) {
 	//don't do anything if there is no data for the worker from the Workday API
 
 	block_positionNumber := make(map[string]string)
@@ -592,17 +417,17 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 
 	//build period_puhcnes - aka time events
 	var periodPunch PeriodPunches
-	for _, v := range worker.Time_Clock_Events {
-		if v.Timeblock_Ref_ID == "" { //add to peroid_punches slice if not associated with a time block
+	for _, v := range data.Time_Events {
+		if v.Time_Block_Reference_ID == "" { //add to peroid_punches slice if not associated with a time block
 			periodPunch.Clock_Event_Type = v.Clock_Event_Type
-			periodPunch.Time_Clock_Event_Date_Time = v.Clock_Event_Time
+			periodPunch.Time_Clock_Event_Date_Time = v.Time
 
 			for _, position := range employee.Positions {
-				if position.Position_Number == v.Position_Ref_ID {
+				if position.Position_Number == v.Position {
 					periodPunch.Business_Title = position.Business_Title
 				}
 			}
-			periodPunch.Position_Number = v.Position_Ref_ID
+			periodPunch.Position_Number = v.Position
 			if periodPunch.Business_Title == "" {
 				periodPunch.Business_Title = "none"
 			}
@@ -610,10 +435,10 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 
 		} else { //get the data to use later for time block in/out
 			if v.Clock_Event_Type == "Check-in" {
-				block_positionNumber[v.Timeblock_Ref_ID] = v.Position_Ref_ID
-				block_timeIn[v.Timeblock_Ref_ID] = v.Clock_Event_Time
+				block_positionNumber[v.Time_Block_Reference_ID] = v.Position
+				block_timeIn[v.Time_Block_Reference_ID] = v.Time
 			} else if v.Clock_Event_Type == "Check-out" {
-				block_timeOut[v.Timeblock_Ref_ID] = v.Clock_Event_Time
+				block_timeOut[v.Time_Block_Reference_ID] = v.Time
 
 			}
 		}
@@ -621,15 +446,8 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 	//associate time events to time block
 	var periodBlock PeriodBlocks
 
-	currentPeriodStart, currentPeriodEnd := ReturnCurrentPayPeriod()
-	currentWeekStart, currentWeekEnd := ReturnCurrentWeek()
-
-	positionWeekTotal := make(map[string]float64)
-	positionPeriodTotal := make(map[string]float64)
-	var totalWeekHours, totalPeriodHours float64
-
 	//loop through returned time blocks and add create the table in employee.PeriodBlocks for the JSON return
-	for _, v := range workerTimeBlocks.Report_Entry {
+	for _, v := range data.Time_Blocks {
 		if v.In_Time == "" || v.Out_Time == "" { //if no valid time don't add the block
 			continue
 		}
@@ -646,11 +464,41 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 		periodBlock.Business_Title = positionTDtoName[v.Position]
 		periodBlock.Length = v.Hours
 		periodBlock.ReferenceID = v.Reference_ID
-		periodBlock.Reported_Date = reportedDate.Format("2006-01-02")
+		//the day the block was worked on as payroll counts days, not the offset workday sent
+		periodBlock.Reported_Date = reportedDate.In(payCalendar.Load().Location()).Format("2006-01-02")
 		periodBlock.Time_Clock_Event_Date_Time_IN = v.In_Time
 		periodBlock.Time_Clock_Event_Date_Time_OUT = v.Out_Time
-		periodBlock.Time_Entry_Code_Ref_ID_from_Source = v.Time_Entry_Code_Ref_ID_from_Source
-		periodBlock.Time_Entry_Code_Ref_ID_Name = employee.TimeCodeNameLookup[v.Time_Entry_Code_Ref_ID_from_Source]
+		periodBlock.Time_Entry_Code_Ref_ID_from_Source = v.Time_Entry_Code
+		periodBlock.Time_Entry_Code_Ref_ID_Name = employee.TimeCodeNameLookup[v.Time_Entry_Code]
+
+		//Logs list of time blocks without valid data
+		if periodBlock.Position_Number == "" || periodBlock.Business_Title == "" || periodBlock.Length == "" || periodBlock.Time_Clock_Event_Date_Time_IN == "" || periodBlock.Time_Clock_Event_Date_Time_OUT == "" || periodBlock.ReferenceID == "" {
+			slog.Warn("incomplete time block", "reference_id", v.Reference_ID)
+			slog.Debug("incomplete time block error", "position", v.Position, "business_title", block_businessTitle[v.Reference_ID], "length", v.Hours, " timeIn", block_timeIn[v.Reference_ID], "timeOut", block_timeOut[v.Reference_ID], "reference_id", v.Reference_ID)
+		}
+		employee.Period_Blocks = append(employee.Period_Blocks, periodBlock)
+	}
+
+	if data.International_Status != "" {
+		employee.International_Status = data.International_Status
+	}
+	employee.Time_Blocks_Source = data.Time_Blocks_Source
+
+	CalculateHourTotals(employee)
+	return nil
+}
+
+// totals the hours in employee.Period_Blocks for the current week and pay period, per position and overall
+func CalculateHourTotals(employee *Employee) {
+	currentPeriod := ReturnCurrentPayPeriod()
+	currentWeek := ReturnCurrentWeek()
+
+	positionWeekTotal := make(map[string]float64)
+	positionPeriodTotal := make(map[string]float64)
+	var totalWeekHours, totalPeriodHours float64
+
+	for i := range employee.Period_Blocks {
+		periodBlock := &employee.Period_Blocks[i]
 
 		//calculate timeBlock period and weekly hours per position and total
 		lengthValue, err := strconv.ParseFloat(periodBlock.Length, 64)
@@ -659,22 +507,15 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 			slog.Debug("could not parse lengthValue", "error", err)
 		}
 
-		if isInDateRange(&periodBlock, currentWeekStart, currentWeekEnd) {
+		if isInDateRange(periodBlock, currentWeek) {
 			positionWeekTotal[periodBlock.Position_Number] = positionWeekTotal[periodBlock.Position_Number] + lengthValue
 			totalWeekHours = totalWeekHours + lengthValue
 		}
 
-		if isInDateRange(&periodBlock, currentPeriodStart, currentPeriodEnd) {
+		if isInDateRange(periodBlock, currentPeriod) {
 			positionPeriodTotal[periodBlock.Position_Number] = positionPeriodTotal[periodBlock.Position_Number] + lengthValue
 			totalPeriodHours = totalPeriodHours + lengthValue
 		}
-
-		//Logs list of time blocks without valid data
-		if periodBlock.Position_Number == "" || periodBlock.Business_Title == "" || periodBlock.Length == "" || periodBlock.Time_Clock_Event_Date_Time_IN == "" || periodBlock.Time_Clock_Event_Date_Time_OUT == "" || periodBlock.ReferenceID == "" {
-			slog.Warn("incomplete time block", "reference_id", v.Reference_ID)
-			slog.Debug("incomplete time block error", "position", v.Position, "business_title", block_businessTitle[v.Reference_ID], "length", v.Hours, " timeIn", block_timeIn[v.Reference_ID], "timeOut", block_timeOut[v.Reference_ID], "reference_id", v.Reference_ID)
-		}
-		employee.Period_Blocks = append(employee.Period_Blocks, periodBlock)
 	}
 
 	//populate position hours to positions table
@@ -705,28 +546,11 @@ func MapEmployeeTimeData(employee *Employee, worker *WorkdayWorkerTimeData, work
 		employee.Total_Period_Hours = "0 H"
 		employee.Total_Week_Hours = "0 H"
 	}
-
-	return nil
-}
-
-// look at reported date and determine if it is within the current date range
-func isInDateRange(periodBlock *PeriodBlocks, timeStart time.Time, timeEnd time.Time) bool {
-	loc, _ := time.LoadLocation("America/Denver")
-	blockDate, err := time.ParseInLocation("2006-01-02", periodBlock.Reported_Date, loc)
-
-	if err != nil {
-		return false
-	}
-
-	if blockDate.After(timeStart) && blockDate.Before(timeEnd) || blockDate.Equal(timeStart) {
-		return true
-	}
-	return false
 }
 
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return base64.StdEncoding.EncodeToString([]byte(auth))
+// look at reported date and determine if it is one of the days in the period, including the first and last
+func isInDateRange(periodBlock *PeriodBlocks, period paycalendar.Period) bool {
+	return period.ContainsDate(periodBlock.Reported_Date)
 }
 
 //------------------------------------------------------------------------------------------------------Workday custom API end------------------------------------------------------------
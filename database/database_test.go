@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/paycalendar"
+)
+
+// a TCD that can't be reached for its first failures calls for pay period overrides
+type downOverridesStore struct {
+	*MemoryStore
+	failures int32
+	calls    atomic.Int32
+}
+
+func (s *downOverridesStore) PayPeriodOverrides(ctx context.Context) ([]paycalendar.Override, error) {
+	if s.calls.Add(1) <= s.failures {
+		return nil, errors.New("dial tcp: connection refused")
+	}
+	return s.MemoryStore.PayPeriodOverrides(ctx)
+}
+
+func TestRefreshPayCalendarOverrides(t *testing.T) {
+	defer func(cfg paycalendar.Config, calendar *paycalendar.Calendar) {
+		payCalendarConfig = cfg
+		payCalendar.Store(calendar)
+	}(payCalendarConfig, payCalendar.Load())
+	defer func(refresh, retry time.Duration) { payCalendarRefresh, payCalendarRetry = refresh, retry }(payCalendarRefresh, payCalendarRetry)
+	payCalendarConfig = paycalendar.DefaultConfig()
+	payCalendarRefresh, payCalendarRetry = time.Hour, time.Millisecond
+
+	store := &downOverridesStore{MemoryStore: NewMemoryStore(), failures: 3}
+	store.SetPayPeriodOverrides([]paycalendar.Override{{Start: "2025-12-20", End: "2026-01-09"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RefreshPayCalendarOverrides(ctx, store)
+	}()
+
+	// the TCD being down at boot only holds the overrides up until it is back
+	deadline := time.Now().Add(5 * time.Second)
+	for payCalendar.Load() == nil || payCalendar.Load().PeriodFor(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)).FirstDay() != "2025-12-20" {
+		if time.Now().After(deadline) {
+			t.Fatalf("overrides not loaded after %d calls", store.calls.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if calls := store.calls.Load(); calls != 4 {
+		t.Errorf("got %d calls, want 3 failures and then the refresh interval", calls)
+	}
+}
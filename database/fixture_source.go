@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FixtureSource reads time data from a JSON file of TimeData by worker ID, for running the timeclock
+// without Workday. The file is read on every request so it can be edited while the server runs.
+type FixtureSource struct {
+	Path string
+}
+
+func (f FixtureSource) TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (TimeData, error) {
+	body, err := os.ReadFile(f.Path)
+	if err != nil {
+		return TimeData{}, fmt.Errorf("could not read time data fixture: %w", err)
+	}
+
+	var workers map[string]TimeData
+	err = json.Unmarshal(body, &workers)
+	if err != nil {
+		return TimeData{}, fmt.Errorf("could not parse time data fixture %s: %w", f.Path, err)
+	}
+
+	data, ok := workers[workerID]
+	if !ok {
+		return TimeData{}, fmt.Errorf("employee not found in time data fixture %s", f.Path)
+	}
+	data.Time_Blocks_Source = TimeBlocksFromFixture
+	return data, nil
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/paycalendar"
+)
+
+// MemoryStore is an in-memory TCDStore for tests and for running the timeclock without a TCD
+type MemoryStore struct {
+	mu        sync.Mutex
+	workers   map[string]TCD_Employee
+	punches   []Punch
+	timeCodes []TimeCodeMapping
+	overrides []paycalendar.Override
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		workers: make(map[string]TCD_Employee),
+	}
+}
+
+// AddWorker adds or replaces a worker in the employee cache
+func (s *MemoryStore) AddWorker(emp TCD_Employee) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers[emp.Worker_ID] = emp
+}
+
+// SetTimeCodeMap replaces the time code map
+func (s *MemoryStore) SetTimeCodeMap(mappings []TimeCodeMapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeCodes = append([]TimeCodeMapping(nil), mappings...)
+}
+
+// SetPayPeriodOverrides replaces the pay period overrides
+func (s *MemoryStore) SetPayPeriodOverrides(overrides []paycalendar.Override) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = append([]paycalendar.Override(nil), overrides...)
+}
+
+func (s *MemoryStore) InsertPunch(ctx context.Context, punch Punch) (PunchResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return PunchResponse{}, err
+	}
+	if punch.Received_At.IsZero() {
+		punch.Received_At = time.Now()
+	}
+	if punch.Time_Clock_Event_Date_Time.IsZero() {
+		punch.Time_Clock_Event_Date_Time = punch.Received_At
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if original, ok := s.findPunch(punch.Punch_ID); ok {
+		return memoryPunchResponse(original), nil
+	}
+	s.punches = append(s.punches, punch)
+	return memoryPunchResponse(punch), nil
+}
+
+func (s *MemoryStore) FindPunch(ctx context.Context, punchID string) (PunchResponse, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return PunchResponse{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	punch, ok := s.findPunch(punchID)
+	if !ok {
+		return PunchResponse{}, false, nil
+	}
+	return memoryPunchResponse(punch), true, nil
+}
+
+// s.mu must be held
+func (s *MemoryStore) findPunch(punchID string) (Punch, bool) {
+	if punchID == "" {
+		return Punch{}, false
+	}
+	for _, p := range s.punches {
+		if p.Punch_ID == punchID {
+			return p, true
+		}
+	}
+	return Punch{}, false
+}
+
+func memoryPunchResponse(punch Punch) PunchResponse {
+	return PunchResponse{
+		Punch_Time:       punch.Time_Clock_Event_Date_Time.Format(time.RFC1123Z),
+		Clock_Event_Type: punch.Clock_Event_Type,
+		Writen_To_TCD:    "true",
+		Queued:           "false",
+	}
+}
+
+func (s *MemoryStore) PendingPunches(ctx context.Context, workerID string) ([]Punch, error) {
+	var punches []Punch
+	if err := ctx.Err(); err != nil {
+		return punches, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.punches {
+		if p.Worker_ID == workerID {
+			punches = append(punches, p)
+		}
+	}
+	return punches, nil
+}
+
+func (s *MemoryStore) GetWorker(ctx context.Context, workerID string) (TCD_Employee, error) {
+	if err := ctx.Err(); err != nil {
+		return TCD_Employee{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	emp, ok := s.workers[workerID]
+	if !ok {
+		return emp, fmt.Errorf("%w: %s", ErrWorkerNotFound, workerID)
+	}
+	return emp, nil
+}
+
+func (s *MemoryStore) TimeCodeMap(ctx context.Context) ([]TimeCodeMapping, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TimeCodeMapping(nil), s.timeCodes...), nil
+}
+
+func (s *MemoryStore) PayPeriodOverrides(ctx context.Context) ([]paycalendar.Override, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]paycalendar.Override(nil), s.overrides...), nil
+}
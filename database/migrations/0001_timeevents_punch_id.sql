@@ -0,0 +1,8 @@
+-- punch_id is the UUID a kiosk sends with a punch, so a retried punch is only recorded once.
+-- InsertPunch relies on the unique index with ON CONFLICT (punch_id) DO NOTHING.
+BEGIN;
+
+ALTER TABLE workday.timeevents ADD COLUMN IF NOT EXISTS punch_id uuid;
+CREATE UNIQUE INDEX IF NOT EXISTS timeevents_punch_id_key ON workday.timeevents (punch_id);
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- time_clock_event_date_time is the time the punch was made at the kiosk, and received_at the time the
+-- timeclock's server got it. Both are timestamptz so punches from clocks in any timezone line up.
+BEGIN;
+
+-- punches written before this were stored as the clocks' local time
+SET LOCAL TIME ZONE 'America/Denver';
+ALTER TABLE workday.timeevents ALTER COLUMN time_clock_event_date_time TYPE timestamptz USING time_clock_event_date_time::timestamptz;
+ALTER TABLE workday.timeevents ADD COLUMN IF NOT EXISTS received_at timestamptz;
+
+COMMIT;
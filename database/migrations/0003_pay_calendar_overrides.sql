@@ -0,0 +1,11 @@
+-- pay periods that don't follow the pay schedule, such as the ones around the winter holidays. The
+-- timeclock adds them to the ones in PAY_CALENDAR_FILE.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS workday.pay_calendar_overrides (
+    period_start date PRIMARY KEY,
+    period_end date NOT NULL,
+    CHECK (period_end >= period_start)
+);
+
+COMMIT;
@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/config"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// JSON from new workday custom API
+type WorkdayTimeBlocksReport struct {
+	Report_Entry []WorkdayTimeBlock `json:"Report_Entry"`
+}
+
+type WorkdayTimeBlock struct {
+	Worker_ID                          string `json:"employee_id"`
+	Time_Code_Groups                   string `json:"time_code_group"`
+	International_Status               string `json:"intl_student"`
+	In_Time                            string `json:"in_time,omitempty"`
+	Out_Time                           string `json:"out_time,omitempty"`
+	Position                           string `json:"position"`
+	Time_Type                          string `json:"time_type,omitempty"`
+	Hours                              string `json:"hours"`
+	Reference_ID                       string `json:"reference_id,omitempty"`
+	Time_Entry_Code_Ref_ID_from_Source string `json:"Time_Entry_Code_Ref_ID_from_Source,omitempty"`
+}
+
+// JSON from old workday custom API
+type WorkdayEmployeeTimeReport struct {
+	Report_Entry []WorkdayWorkerTimeData `json:"Report_Entry"`
+}
+
+type WorkdayWorkerTimeData struct {
+	Worker_ID            string              `json:"employee_id"`
+	Time_Code_Groups     string              `json:"time_code_group"`
+	International_Status string              `json:"intl_student"`
+	Time_Blocks          []WorkdayTimeBlocks `json:"time_blocks"`
+	Time_Clock_Events    []WorkdayTimeEvents `json:"time_clock_events"`
+}
+
+type WorkdayTimeEvents struct {
+	Clock_Event_Time string `json:"time"`             //`json:"clock_event_time"`
+	Clock_Event_Type string `json:"event_type"`       //`json:"clock_event_type"`
+	Position_Ref_ID  string `json:"tce_position"`     //`json:"position_ref_id"`
+	Timeblock_Ref_ID string `json:"timeblock_ref_id"` //`json:"timeblock_ref_id"`
+}
+
+type WorkdayTimeBlocks struct {
+	Reported_Date string `json:"reported_date"`
+	Hours         string `json:"hours"`
+	Time_Type     string `json:"time_type"`
+	Reference_ID  string `json:"reference_id"`
+	Position      string `json:"position"`
+	In_Time       string `json:"in_time"`
+	Out_Time      string `json:"out_time"`
+}
+
+// the reports RaaSSource uses when it isn't configured otherwise
+const (
+	defaultReportOwner      = "ISU_INT265"
+	defaultTimeDataReport   = "INT265_Timekeeping_System"
+	defaultTimeBlocksReport = "INT265_Timeclocks"
+	defaultReportDateOffset = "-00:00"
+)
+
+// RaaSSource gets time data from the ISU_INT265 custom reports. If the INT265_Timeclocks report fails
+// and Time_Blocks_Fallback is set, the time blocks are taken from it instead.
+type RaaSSource struct {
+	// Tenant defaults to WORKDAY_API_TENANT
+	Tenant string
+	// Report_Owner is the account the reports are saved under, ISU_INT265 by default
+	Report_Owner string
+	// Time_Data_Report has the time events and international status, INT265_Timekeeping_System by default
+	Time_Data_Report string
+	// Time_Blocks_Report has the time blocks, INT265_Timeclocks by default
+	Time_Blocks_Report string
+	// Date_Offset is the timezone offset the reports expect on start_date and end_date, -00:00 by default
+	Date_Offset string
+
+	Time_Blocks_Fallback TimeDataSource
+}
+
+// LoadRaaSSource reads the report settings from WORKDAY_REPORT_TENANT, WORKDAY_REPORT_OWNER,
+// WORKDAY_TIME_DATA_REPORT, WORKDAY_TIME_BLOCKS_REPORT and WORKDAY_REPORT_DATE_OFFSET, recording problems on l
+func LoadRaaSSource(l *config.Loader) RaaSSource {
+	r := RaaSSource{
+		Tenant:             l.Get("WORKDAY_REPORT_TENANT"),
+		Report_Owner:       l.Get("WORKDAY_REPORT_OWNER"),
+		Time_Data_Report:   l.Get("WORKDAY_TIME_DATA_REPORT"),
+		Time_Blocks_Report: l.Get("WORKDAY_TIME_BLOCKS_REPORT"),
+		Date_Offset:        l.Get("WORKDAY_REPORT_DATE_OFFSET"),
+	}
+	if r.Date_Offset != "" && !dateOffsetPattern.MatchString(r.Date_Offset) {
+		l.Problem(fmt.Errorf("invalid WORKDAY_REPORT_DATE_OFFSET %q, must be like -07:00 or Z", r.Date_Offset))
+	}
+	return r
+}
+
+var dateOffsetPattern = regexp.MustCompile(`^([+-]\d{2}:\d{2}|Z)$`)
+
+// builds the URL of one of the custom reports for a worker between the dates
+func (r RaaSSource) reportURL(report string, workerID string, start time.Time, end time.Time) (string, error) {
+	tenant := orDefault(r.Tenant, apiTenant)
+	owner := orDefault(r.Report_Owner, defaultReportOwner)
+	offset := orDefault(r.Date_Offset, defaultReportDateOffset)
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid WORKDAY_API_URL: %w", err)
+	}
+	u = u.JoinPath("ccx/service/customreport2", tenant, owner, report)
+
+	query := url.Values{}
+	query.Set("employee_id", workerID)
+	query.Set("start_date", start.Format(time.DateOnly)+offset)
+	query.Set("end_date", end.Format(time.DateOnly)+offset)
+	query.Set("format", "json")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Both reports are requested at the same time; if only one of them succeeds its data is still
+// returned along with the other report's error.
+func (r RaaSSource) TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (TimeData, error) {
+	var data TimeData
+	var workerTimeData WorkdayEmployeeTimeReport
+	var workerTimeBlocks WorkdayTimeBlocksReport
+
+	timeDataReport := orDefault(r.Time_Data_Report, defaultTimeDataReport)
+	timeBlocksReport := orDefault(r.Time_Blocks_Report, defaultTimeBlocksReport)
+
+	//First API Data - used to get time events and international status
+	timeDataURL, err := r.reportURL(timeDataReport, workerID, start, end)
+	if err != nil {
+		return data, err
+	}
+
+	//Second API data - used to get time blocks
+	timeBlocksURL, err := r.reportURL(timeBlocksReport, workerID, start, end)
+	if err != nil {
+		return data, err
+	}
+
+	timeDataDone := make(chan error, 1)
+	timeBlocksDone := make(chan error, 1)
+	go func() {
+		timeDataDone <- getReport(ctx, timeDataReport, timeDataURL, &workerTimeData)
+	}()
+	go func() {
+		timeBlocksDone <- getReport(ctx, timeBlocksReport, timeBlocksURL, &workerTimeBlocks)
+	}()
+
+	// the goroutines may still be writing to the reports if ctx is done, so neither can be used in that case
+	var timeDataErr, timeBlocksErr error
+	for i := 0; i < 2; i++ {
+		select {
+		case timeDataErr = <-timeDataDone:
+			timeDataDone = nil
+		case timeBlocksErr = <-timeBlocksDone:
+			timeBlocksDone = nil
+		case <-ctx.Done():
+			return data, fmt.Errorf("timed out waiting for the workday reports: %w", ctx.Err())
+		}
+	}
+
+	// each report is checked on its own, so one bad report doesn't throw out the other
+	if timeDataErr == nil {
+		if len(workerTimeData.Report_Entry) < 1 {
+			timeDataErr = newReportError(timeDataReport, http.StatusOK, ErrReportWorkerNotFound, "employee not found in workday, empty slice", nil)
+		} else if workerTimeData.Report_Entry[0].Worker_ID == "" {
+			timeDataErr = newReportError(timeDataReport, http.StatusOK, ErrReportPayload, "no employee_id returned", nil)
+		}
+	}
+	if timeBlocksErr == nil {
+		for _, v := range workerTimeBlocks.Report_Entry {
+			if v.Worker_ID != "" && v.Worker_ID != workerID {
+				timeBlocksErr = newReportError(timeBlocksReport, http.StatusOK, ErrReportPayload, "time block "+v.Reference_ID+" is for employee "+v.Worker_ID, nil)
+				break
+			}
+		}
+	}
+
+	if timeDataErr == nil {
+		worker := workerTimeData.Report_Entry[0]
+		data.International_Status = "false"
+		if worker.International_Status == "1" {
+			data.International_Status = "true"
+		}
+		for _, v := range worker.Time_Clock_Events {
+			data.Time_Events = append(data.Time_Events, TimeEvent{
+				Time:                    v.Clock_Event_Time,
+				Clock_Event_Type:        v.Clock_Event_Type,
+				Position:                v.Position_Ref_ID,
+				Time_Block_Reference_ID: v.Timeblock_Ref_ID,
+			})
+		}
+	}
+
+	if timeBlocksErr != nil {
+		if r.Time_Blocks_Fallback != nil {
+			fallback, err := r.Time_Blocks_Fallback.TimeData(ctx, workerID, start, end)
+			if err != nil {
+				timeBlocksErr = errors.Join(timeBlocksErr, err)
+			} else {
+				slog.Warn("using fallback time blocks", "id", workerID, "source", fallback.Time_Blocks_Source, "error", timeBlocksErr)
+				data.Time_Blocks = fallback.Time_Blocks
+				data.Time_Blocks_Source = fallback.Time_Blocks_Source
+				timeBlocksErr = nil
+			}
+		}
+	} else {
+		data.Time_Blocks_Source = TimeBlocksFromReport
+		for _, v := range workerTimeBlocks.Report_Entry {
+			data.Time_Blocks = append(data.Time_Blocks, TimeBlock{
+				Reference_ID:    v.Reference_ID,
+				Position:        v.Position,
+				In_Time:         v.In_Time,
+				Out_Time:        v.Out_Time,
+				Hours:           v.Hours,
+				Time_Entry_Code: v.Time_Entry_Code_Ref_ID_from_Source,
+			})
+		}
+	}
+
+	return data, errors.Join(timeDataErr, timeBlocksErr)
+}
+
+// makes a single request to a workday custom report and unmarshals the JSON body into v.
+// each report gets its own workdayTimeout on top of whatever deadline ctx already has.
+// An error status or a body that isn't the expected JSON comes back as a *ReportError.
+func getReport(ctx context.Context, report string, url string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, workdayTimeout)
+	defer cancel()
+
+	slog.Debug("making request to", "url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", report, err)
+	}
+	err = workday.Authorize(ctx, req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", report, err)
+	}
+
+	response, err := workdayClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", report, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", report, err)
+	}
+
+	err = checkReportResponse(report, response.StatusCode, body)
+	if err == nil {
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			err = newReportError(report, response.StatusCode, ErrReportPayload, err.Error(), body)
+		}
+	}
+	var reportErr *ReportError
+	if errors.As(err, &reportErr) {
+		slog.Error("bad response from workday report", "report", report, "status", reportErr.Status, "kind", reportErr.Kind, "sample", reportErr.Sample)
+	}
+	return err
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+const timeDataReportBody = `{"Report_Entry": [{"employee_id": "123456789", "intl_student": "1", "time_clock_events": [
+	{"time": "2024-03-12T13:00:00-06:00", "event_type": "Check-in", "tce_position": "P1"}
+]}]}`
+
+const timeBlocksReportBody = `{"Report_Entry": [
+	{"employee_id": "123456789", "position": "P1", "in_time": "2024-03-12T08:00:00-06:00", "out_time": "2024-03-12T12:00:00-06:00", "hours": "4", "reference_id": "TB1"}
+]}`
+
+// a TimeDataSource that returns the same thing every time
+type staticSource struct {
+	data TimeData
+	err  error
+}
+
+func (s staticSource) TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (TimeData, error) {
+	return s.data, s.err
+}
+
+// serves the two custom reports, answering each with its handler
+func reportServer(t *testing.T, timeData http.HandlerFunc, timeBlocks http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, ok := r.BasicAuth(); !ok || user != "ISU_INT265" {
+			t.Errorf("report request without the workday credentials")
+		}
+		if r.URL.Query().Get("employee_id") != "123456789" || r.URL.Query().Get("format") != "json" {
+			t.Errorf("report request with query %s", r.URL.RawQuery)
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/"+defaultTimeDataReport):
+			timeData(w, r)
+		case strings.HasSuffix(r.URL.Path, "/"+defaultTimeBlocksReport):
+			timeBlocks(w, r)
+		default:
+			t.Errorf("request for unknown report %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	oldURL, oldTenant := apiURL, apiTenant
+	apiURL, apiTenant = server.URL, "byu"
+	t.Cleanup(func() { apiURL, apiTenant = oldURL, oldTenant })
+	workday.SetCredentials(workday.BasicCredentials{Username: "ISU_INT265", Password: "password"})
+}
+
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestRaaSSource(t *testing.T) {
+	fallbackBlocks := TimeData{Time_Blocks_Source: TimeBlocksFromWebService, Time_Blocks: []TimeBlock{{Reference_ID: "CTB1", Position: "P1"}}}
+
+	tests := []struct {
+		name       string
+		timeData   http.HandlerFunc
+		timeBlocks http.HandlerFunc
+		fallback   TimeDataSource
+		wantEvents int
+		wantBlocks string
+		wantSource string
+		wantKinds  []error
+	}{
+		{
+			name:       "both reports",
+			timeData:   respond(http.StatusOK, timeDataReportBody),
+			timeBlocks: respond(http.StatusOK, timeBlocksReportBody),
+			wantEvents: 1, wantBlocks: "[TB1]", wantSource: TimeBlocksFromReport,
+		},
+		{
+			name:       "worker missing from the time data report",
+			timeData:   respond(http.StatusOK, `{"Report_Entry": []}`),
+			timeBlocks: respond(http.StatusOK, timeBlocksReportBody),
+			wantBlocks: "[TB1]", wantSource: TimeBlocksFromReport,
+			wantKinds: []error{ErrReportWorkerNotFound},
+		},
+		{
+			name:       "time data without an employee_id",
+			timeData:   respond(http.StatusOK, `{"Report_Entry": [{"intl_student": "0"}]}`),
+			timeBlocks: respond(http.StatusOK, timeBlocksReportBody),
+			wantBlocks: "[TB1]", wantSource: TimeBlocksFromReport,
+			wantKinds: []error{ErrReportPayload},
+		},
+		{
+			name:       "time blocks for someone else",
+			timeData:   respond(http.StatusOK, timeDataReportBody),
+			timeBlocks: respond(http.StatusOK, `{"Report_Entry": [{"employee_id": "987654321", "reference_id": "TB9"}]}`),
+			wantEvents: 1, wantBlocks: "[]",
+			wantKinds: []error{ErrReportPayload},
+		},
+		{
+			name:       "time blocks report down with a fallback",
+			timeData:   respond(http.StatusOK, timeDataReportBody),
+			timeBlocks: respond(http.StatusServiceUnavailable, "Service Unavailable"),
+			fallback:   staticSource{data: fallbackBlocks},
+			wantEvents: 1, wantBlocks: "[CTB1]", wantSource: TimeBlocksFromWebService,
+		},
+		{
+			name:       "time blocks report and fallback down",
+			timeData:   respond(http.StatusOK, timeDataReportBody),
+			timeBlocks: respond(http.StatusServiceUnavailable, "Service Unavailable"),
+			fallback:   staticSource{err: workday.ErrServer},
+			wantEvents: 1, wantBlocks: "[]",
+			wantKinds: []error{ErrReportMaintenance, workday.ErrServer},
+		},
+		{
+			name:       "time data report down",
+			timeData:   respond(http.StatusUnauthorized, "Unauthorized"),
+			timeBlocks: respond(http.StatusOK, timeBlocksReportBody),
+			fallback:   staticSource{data: fallbackBlocks},
+			wantBlocks: "[TB1]", wantSource: TimeBlocksFromReport,
+			wantKinds: []error{ErrReportAuthentication},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reportServer(t, tt.timeData, tt.timeBlocks)
+
+			start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			source := RaaSSource{Time_Blocks_Fallback: tt.fallback}
+			data, err := source.TimeData(context.Background(), "123456789", start, start.AddDate(0, 0, 14))
+			if len(tt.wantKinds) == 0 && err != nil {
+				t.Errorf("TimeData() error = %v, want none", err)
+			}
+			for _, kind := range tt.wantKinds {
+				if !errors.Is(err, kind) {
+					t.Errorf("TimeData() error = %v, want %v", err, kind)
+				}
+			}
+
+			var blocks []string
+			for _, block := range data.Time_Blocks {
+				blocks = append(blocks, block.Reference_ID)
+			}
+			if fmt.Sprint(blocks) != tt.wantBlocks || data.Time_Blocks_Source != tt.wantSource {
+				t.Errorf("got blocks %v from %q, want %s from %q", blocks, data.Time_Blocks_Source, tt.wantBlocks, tt.wantSource)
+			}
+			if len(data.Time_Events) != tt.wantEvents {
+				t.Errorf("got %d time events, want %d", len(data.Time_Events), tt.wantEvents)
+			}
+			if tt.wantEvents > 0 && data.International_Status != "true" {
+				t.Errorf("got international status %q, want true", data.International_Status)
+			}
+		})
+	}
+}
+
+func TestReportURL(t *testing.T) {
+	defer func(url, tenant string) { apiURL, apiTenant = url, tenant }(apiURL, apiTenant)
+	apiTenant = "byu"
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		apiURL string
+		source RaaSSource
+		want   string
+	}{
+		{
+			name:   "defaults",
+			apiURL: "https://wd2-impl-services1.workday.com",
+			want:   "https://wd2-impl-services1.workday.com/ccx/service/customreport2/byu/ISU_INT265/INT265_Timeclocks?employee_id=123456789&end_date=2024-03-15-00%3A00&format=json&start_date=2024-03-01-00%3A00",
+		},
+		{
+			name:   "trailing slash and a positive offset",
+			apiURL: "https://wd2-impl-services1.workday.com/",
+			source: RaaSSource{Date_Offset: "+05:30"},
+			want:   "https://wd2-impl-services1.workday.com/ccx/service/customreport2/byu/ISU_INT265/INT265_Timeclocks?employee_id=123456789&end_date=2024-03-15%2B05%3A30&format=json&start_date=2024-03-01%2B05%3A30",
+		},
+		{
+			name:   "path prefix and report settings",
+			apiURL: "https://gateway.byu.edu/workday/",
+			source: RaaSSource{Tenant: "byu_preview", Report_Owner: "ISU INT265"},
+			want:   "https://gateway.byu.edu/workday/ccx/service/customreport2/byu_preview/ISU%20INT265/INT265_Timeclocks?employee_id=123456789&end_date=2024-03-15-00%3A00&format=json&start_date=2024-03-01-00%3A00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiURL = tt.apiURL
+			got, err := tt.source.reportURL(defaultTimeBlocksReport, "123456789", start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("reportURL() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+
+	apiURL = "://not a url"
+	if _, err := (RaaSSource{}).reportURL(defaultTimeBlocksReport, "123456789", start, end); err == nil {
+		t.Error("reportURL() with a bad WORKDAY_API_URL succeeded")
+	}
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of custom report failures. A *ReportError unwraps to one of these.
+var (
+	ErrReportAuthentication = errors.New("workday rejected the report credentials")
+	ErrReportNotFound       = errors.New("workday report not found")
+	ErrReportWorkerNotFound = errors.New("worker is not in the workday report")
+	ErrReportThrottled      = errors.New("workday is throttling report requests")
+	ErrReportMaintenance    = errors.New("workday is unavailable or down for maintenance")
+	ErrReportRejected       = errors.New("workday rejected the report request")
+	ErrReportPayload        = errors.New("workday report returned an unexpected payload")
+)
+
+// how much of a bad response body is kept for the logs
+const reportSampleLength = 300
+
+// ReportError is a failed custom report request
+type ReportError struct {
+	Report string
+	Status int
+	Kind   error
+	// Detail says what was wrong with the payload, if anything
+	Detail string
+	// Sample is the start of the response body
+	Sample string
+}
+
+func (e *ReportError) Error() string {
+	msg := fmt.Sprintf("%s: %s (%d)", e.Report, e.Kind, e.Status)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *ReportError) Unwrap() error {
+	return e.Kind
+}
+
+// checkReportResponse returns a *ReportError if a custom report answered with an error status or
+// something other than JSON
+func checkReportResponse(report string, status int, body []byte) error {
+	trimmed := bytes.TrimSpace(body)
+	html := bytes.HasPrefix(trimmed, []byte("<"))
+
+	var kind error
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		kind = ErrReportAuthentication
+	case status == http.StatusNotFound:
+		kind = ErrReportNotFound
+	case status == http.StatusTooManyRequests:
+		kind = ErrReportThrottled
+	case status >= 500:
+		kind = ErrReportMaintenance
+	case status < 200 || status >= 300:
+		kind = ErrReportRejected
+	case html && bytes.Contains(bytes.ToLower(trimmed), []byte("maintenance")):
+		// workday's maintenance page can come back as a 200
+		kind = ErrReportMaintenance
+	case len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '['):
+		kind = ErrReportPayload
+	default:
+		return nil
+	}
+	return newReportError(report, status, kind, "", body)
+}
+
+func newReportError(report string, status int, kind error, detail string, body []byte) *ReportError {
+	sample := string(bytes.TrimSpace(body))
+	if len(sample) > reportSampleLength {
+		sample = sample[:reportSampleLength] + "..."
+	}
+	return &ReportError{Report: report, Status: status, Kind: kind, Detail: detail, Sample: sample}
+}
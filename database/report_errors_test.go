@@ -0,0 +1,67 @@
+package database
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckReportResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{"report", http.StatusOK, `{"Report_Entry": []}`, nil},
+		{"array", http.StatusOK, ` [] `, nil},
+		{"unauthorized", http.StatusUnauthorized, `{"error": "invalid username or password"}`, ErrReportAuthentication},
+		{"forbidden", http.StatusForbidden, ``, ErrReportAuthentication},
+		{"not found", http.StatusNotFound, `{"error": "report not found"}`, ErrReportNotFound},
+		{"throttled", http.StatusTooManyRequests, ``, ErrReportThrottled},
+		{"server error", http.StatusInternalServerError, `{"error": "internal error"}`, ErrReportMaintenance},
+		{"unavailable", http.StatusServiceUnavailable, `<html><body>Service Unavailable</body></html>`, ErrReportMaintenance},
+		{"bad request", http.StatusBadRequest, `{"error": "invalid prompt value"}`, ErrReportRejected},
+		{"redirect", http.StatusFound, ``, ErrReportRejected},
+		{"maintenance page", http.StatusOK, "\n<!DOCTYPE html><html><title>Workday is down for Scheduled Maintenance</title></html>", ErrReportMaintenance},
+		{"login page", http.StatusOK, `<!DOCTYPE html><html><title>Workday Sign In</title></html>`, ErrReportPayload},
+		{"empty", http.StatusOK, "  \n", ErrReportPayload},
+		{"csv", http.StatusOK, "employee_id,position\n123456789,P1", ErrReportPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReportResponse(defaultTimeDataReport, tt.status, []byte(tt.body))
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("checkReportResponse() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("checkReportResponse() = %v, want %v", err, tt.want)
+			}
+			var reportErr *ReportError
+			if !errors.As(err, &reportErr) || reportErr.Report != defaultTimeDataReport || reportErr.Status != tt.status {
+				t.Errorf("got %#v, want a *ReportError for %s with status %d", err, defaultTimeDataReport, tt.status)
+			}
+			if reportErr.Sample != strings.TrimSpace(tt.body) {
+				t.Errorf("got sample %q, want the body", reportErr.Sample)
+			}
+		})
+	}
+}
+
+func TestReportErrorSample(t *testing.T) {
+	body := "<html>" + strings.Repeat("Workday is down for maintenance. ", 20) + "</html>"
+	err := newReportError(defaultTimeBlocksReport, http.StatusOK, ErrReportMaintenance, "", []byte(body))
+	if len(err.Sample) != reportSampleLength+len("...") || !strings.HasPrefix(body, strings.TrimSuffix(err.Sample, "...")) {
+		t.Errorf("got sample %q, want the first %d bytes of the body", err.Sample, reportSampleLength)
+	}
+
+	err = newReportError(defaultTimeBlocksReport, http.StatusOK, ErrReportPayload, "time block for another employee", nil)
+	want := defaultTimeBlocksReport + ": " + ErrReportPayload.Error() + " (200): time block for another employee"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
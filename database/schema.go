@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrSchema is returned by CheckSchema when the TCD is missing one of the migrations in database/migrations
+var ErrSchema = errors.New("TCD schema is out of date")
+
+// a column the timeclock needs, and the migration that adds it
+type schemaColumn struct {
+	name      string
+	dataType  string
+	migration string
+}
+
+var timeeventsColumns = []schemaColumn{
+	{name: "punch_id", dataType: "uuid", migration: "0001_timeevents_punch_id.sql"},
+	{name: "time_clock_event_date_time", dataType: "timestamp with time zone", migration: "0002_timeevents_received_at.sql"},
+	{name: "received_at", dataType: "timestamp with time zone", migration: "0002_timeevents_received_at.sql"},
+}
+
+var payCalendarOverridesColumns = []schemaColumn{
+	{name: "period_start", dataType: "date", migration: "0003_pay_calendar_overrides.sql"},
+	{name: "period_end", dataType: "date", migration: "0003_pay_calendar_overrides.sql"},
+}
+
+const tableColumnsQuery = `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = 'workday' AND table_name = $1;`
+
+// whether workday.timeevents has a unique index on punch_id alone, which ON CONFLICT (punch_id) needs
+const punchIDIndexQuery = `SELECT EXISTS (
+	SELECT 1 FROM pg_index i
+	JOIN pg_class c ON c.oid = i.indrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = i.indkey[0]
+	WHERE n.nspname = 'workday' AND c.relname = 'timeevents' AND i.indisunique AND i.indnatts = 1 AND i.indpred IS NULL AND a.attname = 'punch_id'
+);`
+
+// CheckSchema makes sure workday.timeevents and workday.pay_calendar_overrides have the columns and index
+// from database/migrations. If they don't, the error wraps ErrSchema and names each migration that still
+// needs to be run.
+func (s *PostgresStore) CheckSchema(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	dataTypes, err := s.tableColumns(ctx, "timeevents")
+	if err != nil {
+		return err
+	}
+	if len(dataTypes) == 0 {
+		return fmt.Errorf("%w: workday.timeevents does not exist or can not be read", ErrSchema)
+	}
+	problems := checkColumns("timeevents", dataTypes, timeeventsColumns)
+
+	var unique bool
+	err = s.db.QueryRowContext(ctx, punchIDIndexQuery).Scan(&unique)
+	if err != nil {
+		return fmt.Errorf("error querying the timeevents indexes: %w", err)
+	}
+	if !unique {
+		problems = append(problems, fmt.Errorf("%w: workday.timeevents has no unique index on punch_id, run 0001_timeevents_punch_id.sql", ErrSchema))
+	}
+
+	dataTypes, err = s.tableColumns(ctx, "pay_calendar_overrides")
+	if err != nil {
+		return err
+	}
+	if len(dataTypes) == 0 {
+		problems = append(problems, fmt.Errorf("%w: workday.pay_calendar_overrides does not exist, run 0003_pay_calendar_overrides.sql", ErrSchema))
+	} else {
+		problems = append(problems, checkColumns("pay_calendar_overrides", dataTypes, payCalendarOverridesColumns)...)
+	}
+	return errors.Join(problems...)
+}
+
+// returns the data type of each column in the workday table
+func (s *PostgresStore) tableColumns(ctx context.Context, table string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, tableColumnsQuery, table)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	dataTypes := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		err := rows.Scan(&name, &dataType)
+		if err != nil {
+			return nil, fmt.Errorf("can not scan the returned %s column: %w", table, err)
+		}
+		dataTypes[name] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the %s columns: %w", table, err)
+	}
+	return dataTypes, nil
+}
+
+func checkColumns(table string, dataTypes map[string]string, columns []schemaColumn) []error {
+	var problems []error
+	for _, column := range columns {
+		dataType, ok := dataTypes[column.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("%w: workday.%s has no %s column, run %s", ErrSchema, table, column.name, column.migration))
+		case dataType != column.dataType:
+			problems = append(problems, fmt.Errorf("%w: workday.%s.%s is %s instead of %s, run %s", ErrSchema, table, column.name, dataType, column.dataType, column.migration))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/paycalendar"
+)
+
+// TCDStore is everything the timeclock reads from and writes to the TCD
+type TCDStore interface {
+	// InsertPunch writes a single punch to workday.timeevents. A punch with the Punch_ID of one that is
+	// already there is not written again, and the original punch's response is returned.
+	InsertPunch(ctx context.Context, punch Punch) (PunchResponse, error)
+	// FindPunch returns the response for the punch already written with punchID, if there is one
+	FindPunch(ctx context.Context, punchID string) (PunchResponse, bool, error)
+	// PendingPunches returns the punches for a worker that have not been uploaded to Workday yet
+	PendingPunches(ctx context.Context, workerID string) ([]Punch, error)
+	// GetWorker returns the employee_cache row for a worker
+	GetWorker(ctx context.Context, workerID string) (TCD_Employee, error)
+	// TimeCodeMap returns every row of workday.time_entry_code_map that has a ui_name
+	TimeCodeMap(ctx context.Context) ([]TimeCodeMapping, error)
+	// PayPeriodOverrides returns the explicit pay periods in workday.pay_calendar_overrides
+	PayPeriodOverrides(ctx context.Context) ([]paycalendar.Override, error)
+}
+
+// a row in workday.time_entry_code_map
+type TimeCodeMapping struct {
+	Time_Code_Groups       string `json:"time_code_groups"`
+	Time_Entry_Code        string `json:"time_entry_code"`
+	Entry_Method           string `json:"entry_method"`
+	Time_Code_Reference_ID string `json:"time_code_reference_id"`
+	UI_Name                string `json:"ui_name"`
+	Sort_Order             int    `json:"sort_order"`
+}
+
+// ErrWorkerNotFound is returned when a worker is not in the employee_cache
+var ErrWorkerNotFound = errors.New("no worker at byuID from employee_cache database")
+
+// PostgresStore is the TCDStore backed by the TCD postgres database
+type PostgresStore struct {
+	db      *sql.DB
+	timeout time.Duration
+}
+
+// NewPostgresStore returns a TCDStore that uses db. Every call gives up after timeout,
+// even if the caller's context allows longer.
+func NewPostgresStore(db *sql.DB, timeout time.Duration) *PostgresStore {
+	return &PostgresStore{db: db, timeout: timeout}
+}
+
+// DefaultStore returns a TCDStore for the database configured by the WORKDAY_DB_* environment variables
+func DefaultStore() *PostgresStore {
+	return NewPostgresStore(db, tcdTimeout)
+}
+
+// get all punches for a given worker_id from the TCD
+const getPunchesQuery = `SELECT employee_id, clock_event_type, time_entry_code, comment, time_clock_event_date_time, position_id
+FROM workday.timeevents WHERE employee_id = $1 AND uploaded_to_workday_date_time IS NULL AND failed_to_upload IS false;`
+
+func (s *PostgresStore) PendingPunches(ctx context.Context, workerID string) ([]Punch, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var punches []Punch
+	slog.Debug("Stats", "DatabaseOpenConnections", s.db.Stats().OpenConnections)
+
+	rows, err := s.db.QueryContext(ctx, getPunchesQuery, workerID)
+	if err != nil {
+		return punches, fmt.Errorf("error querying timeevents for %s: %w", workerID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row Punch
+		err := rows.Scan(&row.Worker_ID, &row.Clock_Event_Type, &row.Time_Entry_Code, &row.Comment, &row.Time_Clock_Event_Date_Time, &row.Position_Number)
+		if err != nil {
+			return punches, fmt.Errorf("can not scan the returned timeevents row: %w", err)
+		}
+		punches = append(punches, row)
+	}
+	return punches, rows.Err()
+}
+
+// write a single punch to the postgres database - called form each individual pi on a punch event
+const insertPunchQuery = `INSERT INTO workday.timeevents(employee_id, position_id, clock_event_type, time_entry_code, "comment", time_clock_event_date_time, pi_hostname, punch_id, received_at)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (punch_id) DO NOTHING;`
+
+func (s *PostgresStore) InsertPunch(ctx context.Context, punch Punch) (PunchResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var punchResponse PunchResponse
+	hostname, err := os.Hostname()
+	if err != nil {
+		return punchResponse, fmt.Errorf("error gettng hostname: %w", err)
+	}
+	// the punch time is when the punch was made, not when it gets here, so queued punches keep their time
+	dateTime := punch.Time_Clock_Event_Date_Time
+	receivedAt := punch.Received_At
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	if dateTime.IsZero() {
+		dateTime = receivedAt
+	}
+
+	punchID := sql.NullString{String: punch.Punch_ID, Valid: punch.Punch_ID != ""}
+	result, err := s.db.ExecContext(ctx, insertPunchQuery, punch.Worker_ID, punch.Position_Number, punch.Clock_Event_Type, punch.Time_Entry_Code, punch.Comment, dateTime, hostname, punchID, receivedAt)
+	if err != nil {
+		return punchResponse, fmt.Errorf("error inserting punch into timeevents: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return punchResponse, fmt.Errorf("unable to confirm punch was inserted into timeevents: %w", err)
+	}
+	if affected == 0 && punchID.Valid {
+		original, ok, err := s.FindPunch(ctx, punch.Punch_ID)
+		if err != nil {
+			return punchResponse, err
+		}
+		if ok {
+			slog.Info("punch already in timeevents", "punch_id", punch.Punch_ID)
+			return original, nil
+		}
+	}
+	if affected != 1 {
+		return punchResponse, fmt.Errorf("expected to insert 1 punch into timeevents, inserted %d", affected)
+	}
+
+	punchResponse.Punch_Time = dateTime.Format(time.RFC1123Z)
+	punchResponse.Clock_Event_Type = punch.Clock_Event_Type
+	punchResponse.Writen_To_TCD = "true"
+	punchResponse.Queued = "false"
+	return punchResponse, nil
+}
+
+const findPunchQuery = `SELECT clock_event_type, time_clock_event_date_time, pi_hostname FROM workday.timeevents WHERE punch_id = $1;`
+
+func (s *PostgresStore) FindPunch(ctx context.Context, punchID string) (PunchResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var punchResponse PunchResponse
+	var dateTime time.Time
+	err := s.db.QueryRowContext(ctx, findPunchQuery, punchID).Scan(&punchResponse.Clock_Event_Type, &dateTime, &punchResponse.Hostname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return punchResponse, false, nil
+	}
+	if err != nil {
+		return punchResponse, false, fmt.Errorf("error querying timeevents for punch %s: %w", punchID, err)
+	}
+
+	punchResponse.Punch_Time = dateTime.Format(time.RFC1123Z)
+	punchResponse.Writen_To_TCD = "true"
+	punchResponse.Queued = "false"
+	return punchResponse, true, nil
+}
+
+const getWorkerQuery = `SELECT worker_id, byu_id, last_updated, employee_name, time_code_group, positions FROM workday.employee_cache WHERE worker_id = $1;`
+
+func (s *PostgresStore) GetWorker(ctx context.Context, workerID string) (TCD_Employee, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var emp TCD_Employee
+	err := s.db.QueryRowContext(ctx, getWorkerQuery, workerID).Scan(&emp.Worker_ID, &emp.BYU_ID, &emp.Last_Updated, &emp.Employee_Name, &emp.Time_Code_Group, &emp.Positions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return emp, fmt.Errorf("%w: %s", ErrWorkerNotFound, workerID)
+	}
+	if err != nil {
+		return emp, fmt.Errorf("error querying employee_cache for %s: %w", workerID, err)
+	}
+	return emp, nil
+}
+
+// receives list of time codes, queries the database and returns a time code struct with data from the database table
+const getTimeCodesQuery = `SELECT time_code_groups, time_entry_code, entry_method, time_code_reference_id, ui_name, sort_order FROM workday.time_entry_code_map WHERE ui_name is not null ;`
+
+func (s *PostgresStore) TimeCodeMap(ctx context.Context) ([]TimeCodeMapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var mappings []TimeCodeMapping
+	rows, err := s.db.QueryContext(ctx, getTimeCodesQuery)
+	if err != nil {
+		return mappings, fmt.Errorf("error querying time_entry_code_map: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row TimeCodeMapping
+		err := rows.Scan(&row.Time_Code_Groups, &row.Time_Entry_Code, &row.Entry_Method, &row.Time_Code_Reference_ID, &row.UI_Name, &row.Sort_Order)
+		if err != nil {
+			return mappings, fmt.Errorf("can not scan the returned time_entry_code_map row: %w", err)
+		}
+		mappings = append(mappings, row)
+	}
+	return mappings, rows.Err()
+}
+
+const getPayPeriodOverridesQuery = `SELECT period_start, period_end FROM workday.pay_calendar_overrides ORDER BY period_start;`
+
+func (s *PostgresStore) PayPeriodOverrides(ctx context.Context) ([]paycalendar.Override, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var overrides []paycalendar.Override
+	rows, err := s.db.QueryContext(ctx, getPayPeriodOverridesQuery)
+	if err != nil {
+		return overrides, fmt.Errorf("error querying pay_calendar_overrides: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start, end time.Time
+		err := rows.Scan(&start, &end)
+		if err != nil {
+			return overrides, fmt.Errorf("can not scan the returned pay_calendar_overrides row: %w", err)
+		}
+		overrides = append(overrides, paycalendar.Override{Start: start.Format(time.DateOnly), End: end.Format(time.DateOnly)})
+	}
+	return overrides, rows.Err()
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/config"
+)
+
+// TimeBlock is a calculated time block from Workday
+type TimeBlock struct {
+	Reference_ID    string `json:"reference_id"`
+	Position        string `json:"position"`
+	In_Time         string `json:"in_time"`
+	Out_Time        string `json:"out_time"`
+	Hours           string `json:"hours"`
+	Time_Entry_Code string `json:"time_entry_code,omitempty"`
+}
+
+// TimeEvent is a punch Workday has received, which may already be part of a time block
+type TimeEvent struct {
+	Time string `json:"time"`
+	// Clock_Event_Type is Check-in or Check-out
+	Clock_Event_Type        string `json:"clock_event_type"`
+	Position                string `json:"position"`
+	Time_Block_Reference_ID string `json:"time_block_reference_id,omitempty"`
+}
+
+// TimeData is a worker's time data from Workday, whichever source it came from
+type TimeData struct {
+	// International_Status is "true" or "false", or empty if the source doesn't know it
+	International_Status string      `json:"international_status"`
+	Time_Blocks          []TimeBlock `json:"time_blocks"`
+	Time_Events          []TimeEvent `json:"time_events"`
+	// Time_Blocks_Source is TimeBlocksFromReport, TimeBlocksFromWebService or TimeBlocksFromFixture
+	Time_Blocks_Source string `json:"-"`
+}
+
+// TimeDataSource gets a worker's time data between two dates. If only part of it could be gotten,
+// that part is returned along with an error describing the rest.
+type TimeDataSource interface {
+	TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (TimeData, error)
+}
+
+// the source GetTimeSheet uses - set with WORKDAY_TIME_DATA_SOURCE
+var timeDataSource TimeDataSource
+
+// SetTimeDataSource changes where GetTimeSheet gets time data from
+func SetTimeDataSource(source TimeDataSource) {
+	timeDataSource = source
+}
+
+// LoadTimeDataSource picks the source named by WORKDAY_TIME_DATA_SOURCE: raas (the default) for the
+// INT265 custom reports falling back to Get_Calculated_Time_Blocks for time blocks, soap for only
+// Get_Calculated_Time_Blocks, or fixture for the JSON file in WORKDAY_TIME_DATA_FIXTURE. Problems are
+// recorded on l.
+func LoadTimeDataSource(l *config.Loader) TimeDataSource {
+	switch name := l.Get("WORKDAY_TIME_DATA_SOURCE"); name {
+	case "", "raas":
+		source := LoadRaaSSource(l)
+		source.Time_Blocks_Fallback = TimeBlocksSource{}
+		return source
+	case "soap":
+		return TimeBlocksSource{}
+	case "fixture":
+		path := l.Get("WORKDAY_TIME_DATA_FIXTURE")
+		if path == "" {
+			l.Problem(fmt.Errorf("WORKDAY_TIME_DATA_FIXTURE must be set to use the fixture time data source"))
+		}
+		return FixtureSource{Path: path}
+	default:
+		l.Problem(fmt.Errorf("invalid WORKDAY_TIME_DATA_SOURCE %q, must be raas, soap or fixture", name))
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// ErrInvalidPunch is returned for a punch that can't be recorded however many times it is sent
+var ErrInvalidPunch = errors.New("invalid punch")
+
+// WorkdayPunchWriter sends punches straight to Workday with Put_Time_Clock_Events instead of writing
+// them to the TCD for the uploader to pick up
+type WorkdayPunchWriter struct{}
+
+func (WorkdayPunchWriter) InsertPunch(ctx context.Context, punch Punch) (PunchResponse, error) {
+	var punchResponse PunchResponse
+	event, err := TimeClockEventFromPunch(punch)
+	if err != nil {
+		return punchResponse, err
+	}
+
+	referenceIDs, err := workday.PutTimeClockEvents(ctx, []workday.TimeClockEvent{event})
+	if err != nil {
+		return punchResponse, fmt.Errorf("error sending punch to workday: %w", err)
+	}
+
+	punchResponse.Punch_Time = event.Date_Time.Format(time.RFC1123Z)
+	punchResponse.Clock_Event_Type = punch.Clock_Event_Type
+	punchResponse.Writen_To_TCD = "false"
+	punchResponse.Queued = "false"
+	punchResponse.Workday_Reference_ID = referenceIDs[0]
+	return punchResponse, nil
+}
+
+// TimeClockEventFromPunch converts a punch as the TCD stores it to the event Workday expects
+func TimeClockEventFromPunch(punch Punch) (workday.TimeClockEvent, error) {
+	event := workday.TimeClockEvent{
+		Worker_ID:       punch.Worker_ID,
+		Position_ID:     punch.Position_Number,
+		Time_Entry_Code: punch.Time_Entry_Code,
+		Comment:         punch.Comment,
+		Date_Time:       punch.Time_Clock_Event_Date_Time,
+	}
+
+	switch punch.Clock_Event_Type {
+	case "IN":
+		event.Clock_Event_Type = "Check-in"
+	case "OUT":
+		event.Clock_Event_Type = "Check-out"
+	default:
+		return event, fmt.Errorf("%w: clock_event_type %q must be IN or OUT", ErrInvalidPunch, punch.Clock_Event_Type)
+	}
+
+	if event.Date_Time.IsZero() {
+		event.Date_Time = time.Now()
+	}
+	if event.Comment == "" {
+		hostname, _ := os.Hostname()
+		event.Comment = "Wall Clock Punch from: " + hostname
+	}
+	return event, nil
+}
@@ -0,0 +1,540 @@
+package event
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	PENDING_BUCKET     = "PENDING"
+	DEAD_LETTER_BUCKET = "DEAD_LETTER"
+)
+
+// ErrQueueFull is returned by Publish when a host already has Queue_Size events waiting
+var ErrQueueFull = errors.New("event queue is full")
+
+// Dispatcher sends events to each sink in the background. Every sink has its own bounded queue and is
+// retried with exponential backoff, so a sink that is slow or down doesn't hold up the others or the caller.
+// An event waiting to be retried doesn't hold up newer events for its sink either, so a sink can get events
+// out of order.
+type Dispatcher struct {
+	// Sinks need different names, which events on disk are kept under
+	Sinks []Sink
+	// Queue_Size is how many events can wait for each sink, defaults to 1000
+	Queue_Size int
+	// Max_Attempts is how many times an event is sent to a sink before it is dead-lettered, defaults to 10
+	Max_Attempts int
+	// Min_Backoff and Max_Backoff bound the wait between attempts, defaults to 1s and 5m
+	Min_Backoff time.Duration
+	Max_Backoff time.Duration
+	// Path is an optional bbolt file that queued events are kept in until they are delivered, so they
+	// survive a restart, along with the dead letters
+	Path string
+
+	once   sync.Once
+	hosts  map[string]*hostQueue
+	db     atomic.Pointer[bolt.DB]
+	wg     sync.WaitGroup
+	closed atomic.Bool
+}
+
+// What happened to an event sent to a host by Send
+const (
+	Delivered = "delivered"
+	Queued    = "queued"
+	Failed    = "failed"
+)
+
+// HostResult is what happened to an event sent to one sink by Send. Host is the sink's name.
+type HostResult struct {
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HostStatus is how delivery to one sink is going since the dispatcher started. Host is the sink's name.
+type HostStatus struct {
+	Host          string    `json:"host"`
+	Queued        int       `json:"queued"`
+	Delivered     int64     `json:"delivered"`
+	Dead_Lettered int64     `json:"dead_lettered"`
+	Last_Error    string    `json:"last_error,omitempty"`
+	Last_Error_At time.Time `json:"last_error_at,omitempty"`
+}
+
+type hostQueue struct {
+	sink  Sink
+	queue chan delivery
+
+	mu     sync.Mutex
+	status HostStatus
+	// how many events are out of queue waiting to be retried
+	retrying int
+}
+
+// how many events are waiting to be sent, counting the ones waiting to be retried
+func (q *hostQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue) + q.retrying
+}
+
+func (q *hostQueue) setRetrying(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retrying = n
+}
+
+func (q *hostQueue) delivered() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.status.Delivered++
+}
+
+func (q *hostQueue) failed(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.status.Last_Error, q.status.Last_Error_At = err.Error(), time.Now()
+}
+
+type delivery struct {
+	host string
+	// key in the host's pending bucket, nil if the event isn't on disk
+	key   []byte
+	event events.Event
+	// the event as it is kept on disk
+	body []byte
+	// how many times it has been sent, and when to try again
+	attempts int
+	retryAt  time.Time
+}
+
+// a dead-lettered event and why it couldn't be delivered
+type deadLetter struct {
+	Host      string          `json:"host"`
+	Event     json.RawMessage `json:"event"`
+	Error     string          `json:"error"`
+	Attempts  int             `json:"attempts"`
+	Failed_At time.Time       `json:"failed_at"`
+}
+
+func (d *Dispatcher) init() {
+	d.once.Do(func() {
+		size := d.Queue_Size
+		if size <= 0 {
+			size = 1000
+		}
+		d.hosts = make(map[string]*hostQueue, len(d.Sinks))
+		for _, sink := range d.Sinks {
+			d.hosts[sink.Name()] = &hostQueue{sink: sink, queue: make(chan delivery, size), status: HostStatus{Host: sink.Name()}}
+		}
+	})
+}
+
+// Start opens the disk queue, if there is one, and sends queued events until ctx is done
+func (d *Dispatcher) Start(ctx context.Context) error {
+	d.init()
+	if d.Path != "" {
+		db, err := openQueue(d.Path)
+		if err != nil {
+			return err
+		}
+		d.db.Store(db)
+		d.reload(db)
+	}
+
+	for host, q := range d.hosts {
+		d.wg.Add(1)
+		go func(host string, q *hostQueue) {
+			defer d.wg.Done()
+			d.run(ctx, host, q)
+		}(host, q)
+	}
+	return nil
+}
+
+// Close waits for the senders to stop, once the context given to Start is done, and closes the sinks and
+// the disk queue. Events that were still queued are sent after the next Start.
+func (d *Dispatcher) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	d.wg.Wait()
+
+	var errs []error
+	for _, sink := range d.Sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	if db := d.db.Swap(nil); db != nil {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Publish queues e for every sink and returns straight away. If a sink's queue is full the event is
+// dropped for that sink only and ErrQueueFull is returned.
+func (d *Dispatcher) Publish(e events.Event) error {
+	d.init()
+	if len(d.Sinks) == 0 {
+		return nil
+	}
+
+	e, body, err := marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, sink := range d.Sinks {
+		host := sink.Name()
+		err := d.enqueue(delivery{host: host, event: e, body: body})
+		if err != nil {
+			slog.Warn("event dropped", "host", host, "key", e.Key, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Dispatcher) enqueue(dl delivery) error {
+	q := d.hosts[dl.host]
+	if q.queued() >= cap(q.queue) {
+		return ErrQueueFull
+	}
+
+	// the event is written to disk first so the sender can't deliver it before it is there to remove
+	db := d.db.Load()
+	if db != nil {
+		key, err := storePending(db, dl)
+		if err != nil {
+			slog.Warn("unable to add event to the disk queue, it will only be kept in memory", "host", dl.host, "error", err)
+		}
+		dl.key = key
+	}
+
+	select {
+	case q.queue <- dl:
+		return nil
+	default:
+		d.remove(dl)
+		return ErrQueueFull
+	}
+}
+
+// Send sends e to every sink and waits for them to answer. Sinks that can't be reached get the event
+// queued for the background retries instead.
+func (d *Dispatcher) Send(ctx context.Context, e events.Event) ([]HostResult, error) {
+	d.init()
+	e, body, err := marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]HostResult, len(d.Sinks))
+	var wg sync.WaitGroup
+	for i, sink := range d.Sinks {
+		wg.Add(1)
+		go func(i int, dl delivery) {
+			defer wg.Done()
+			results[i] = d.send(ctx, dl)
+		}(i, delivery{host: sink.Name(), event: e, body: body})
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (d *Dispatcher) send(ctx context.Context, dl delivery) HostResult {
+	host := dl.host
+	q := d.hosts[host]
+	err := q.sink.Send(ctx, dl.event)
+	if err == nil {
+		q.delivered()
+		return HostResult{Host: host, Status: Delivered}
+	}
+	q.failed(err)
+
+	result := HostResult{Host: host, Status: Failed, Error: err.Error()}
+	if errors.Is(err, ErrRejected) {
+		return result
+	}
+	qerr := d.enqueue(dl)
+	if qerr != nil {
+		result.Error = fmt.Sprintf("%s, and it could not be queued: %s", err, qerr)
+		return result
+	}
+	result.Status = Queued
+	return result
+}
+
+// Status returns how delivery is going for each sink, in the order of Sinks
+func (d *Dispatcher) Status() []HostStatus {
+	d.init()
+	statuses := make([]HostStatus, 0, len(d.Sinks))
+	for _, sink := range d.Sinks {
+		q := d.hosts[sink.Name()]
+		q.mu.Lock()
+		status := q.status
+		status.Queued = len(q.queue) + q.retrying
+		q.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// sends the host's events as they are queued, and the ones that failed once their backoff is up
+func (d *Dispatcher) run(ctx context.Context, host string, q *hostQueue) {
+	// events waiting to be retried, in the order they are due
+	var retries []delivery
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		var due <-chan time.Time
+		if len(retries) > 0 {
+			timer.Reset(time.Until(retries[0].retryAt))
+			due = timer.C
+		}
+
+		var dl delivery
+		select {
+		case <-ctx.Done():
+			// events on disk are sent again after the next Start
+			return
+		case dl = <-q.queue:
+		case <-due:
+			dl, retries = retries[0], retries[1:]
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		retry, ok := d.deliver(ctx, q, dl)
+		if ok {
+			i := sort.Search(len(retries), func(i int) bool { return retries[i].retryAt.After(retry.retryAt) })
+			retries = slices.Insert(retries, i, retry)
+		}
+		q.setRetrying(len(retries))
+	}
+}
+
+// sends an event once. If it fails and can be tried again it is returned with when to retry it,
+// otherwise it is dead-lettered.
+func (d *Dispatcher) deliver(ctx context.Context, q *hostQueue, dl delivery) (delivery, bool) {
+	maxAttempts := d.Max_Attempts
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+
+	dl.attempts++
+	err := q.sink.Send(ctx, dl.event)
+	if err == nil {
+		d.remove(dl)
+		q.delivered()
+		return dl, false
+	}
+	if ctx.Err() != nil {
+		// shutting down - an event on disk is sent again after the next Start
+		return dl, false
+	}
+
+	q.failed(err)
+
+	if dl.attempts >= maxAttempts || errors.Is(err, ErrRejected) {
+		d.deadLetter(dl, dl.attempts, err)
+		q.mu.Lock()
+		q.status.Dead_Lettered++
+		q.mu.Unlock()
+		return dl, false
+	}
+
+	backoff := d.backoff(dl.attempts)
+	dl.retryAt = time.Now().Add(backoff)
+	slog.Debug("unable to send event, retrying", "host", dl.host, "attempt", dl.attempts, "backoff", backoff, "error", err)
+	return dl, true
+}
+
+// how long to wait after an event's attempt-th failed attempt, doubling from Min_Backoff up to Max_Backoff
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.Min_Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := d.Max_Backoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Minute
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+func (d *Dispatcher) remove(dl delivery) {
+	db := d.db.Load()
+	if db == nil || dl.key == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return pendingBucket(tx, dl.host).Delete(dl.key)
+	})
+	if err != nil {
+		slog.Warn("unable to remove event from the disk queue", "host", dl.host, "error", err)
+	}
+}
+
+func (d *Dispatcher) deadLetter(dl delivery, attempts int, cause error) {
+	slog.Error("unable to send event, giving up", "host", dl.host, "attempts", attempts, "error", cause, "event", string(dl.body))
+
+	db := d.db.Load()
+	if db == nil {
+		return
+	}
+	value, err := json.Marshal(deadLetter{Host: dl.host, Event: dl.body, Error: cause.Error(), Attempts: attempts, Failed_At: time.Now()})
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(DEAD_LETTER_BUCKET))
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(sequenceKey(seq), value)
+			if err != nil || dl.key == nil {
+				return err
+			}
+			return pendingBucket(tx, dl.host).Delete(dl.key)
+		})
+	}
+	if err != nil {
+		slog.Warn("unable to add event to the dead letter bucket", "host", dl.host, "error", err)
+	}
+}
+
+// DeadLetters returns the number of events in the dead letter bucket
+func (d *Dispatcher) DeadLetters() int {
+	db := d.db.Load()
+	if db == nil {
+		return 0
+	}
+	count := 0
+	_ = db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket([]byte(DEAD_LETTER_BUCKET)).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+func openQueue(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open event queue at %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{PENDING_BUCKET, DEAD_LETTER_BUCKET} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("error creating the %s bucket: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// puts the events left on disk by the last run back in the queues, oldest first. Events for hosts that are
+// no longer configured, or that don't fit, are dead-lettered.
+func (d *Dispatcher) reload(db *bolt.DB) {
+	var pending []delivery
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PENDING_BUCKET)).ForEachBucket(func(host []byte) error {
+			return tx.Bucket([]byte(PENDING_BUCKET)).Bucket(host).ForEach(func(key, value []byte) error {
+				pending = append(pending, delivery{host: string(host), key: append([]byte(nil), key...), body: append([]byte(nil), value...)})
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		slog.Error("unable to read the disk event queue", "path", d.Path, "error", err)
+		return
+	}
+
+	for _, dl := range pending {
+		q, ok := d.hosts[dl.host]
+		if !ok {
+			d.deadLetter(dl, 0, errors.New("host is no longer configured"))
+			continue
+		}
+		err := json.Unmarshal(dl.body, &dl.event)
+		if err != nil {
+			d.deadLetter(dl, 0, fmt.Errorf("unable to unmarshal queued event: %w", err))
+			continue
+		}
+		select {
+		case q.queue <- dl:
+		default:
+			d.deadLetter(dl, 0, ErrQueueFull)
+		}
+	}
+	if len(pending) > 0 {
+		slog.Info("reloaded queued events", "path", d.Path, "events", len(pending))
+	}
+}
+
+func storePending(db *bolt.DB, dl delivery) ([]byte, error) {
+	var key []byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket([]byte(PENDING_BUCKET)).CreateBucketIfNotExists([]byte(dl.host))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key = sequenceKey(seq)
+		return bucket.Put(key, dl.body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func pendingBucket(tx *bolt.Tx, host string) *bolt.Bucket {
+	bucket := tx.Bucket([]byte(PENDING_BUCKET)).Bucket([]byte(host))
+	if bucket == nil {
+		// nothing to remove; an empty bucket's Delete is a no-op
+		bucket, _ = tx.Bucket([]byte(PENDING_BUCKET)).CreateBucketIfNotExists([]byte(host))
+	}
+	return bucket
+}
+
+// big endian so keys sort in the order events were queued
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,291 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// records the keys of the events it gets, answering with status until failures run out
+type eventServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []string
+	attempts int
+	failures int
+	status   int
+}
+
+func newEventServer(t *testing.T, failures int, status int) *eventServer {
+	t.Helper()
+	s := &eventServer{failures: failures, status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		err := json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			t.Errorf("bad event: %s", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attempts++
+		if s.failures != 0 {
+			s.failures--
+			w.WriteHeader(s.status)
+			return
+		}
+		s.keys = append(s.keys, e.Key)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *eventServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func (s *eventServer) attemptCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func httpSinks(urls ...string) []Sink {
+	var sinks []Sink
+	for _, url := range urls {
+		sinks = append(sinks, HTTPSink{URL: url})
+	}
+	return sinks
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcherRetriesEachHost(t *testing.T) {
+	flaky := newEventServer(t, 2, http.StatusServiceUnavailable)
+	healthy := newEventServer(t, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &Dispatcher{Sinks: httpSinks(flaky.URL, healthy.URL), Min_Backoff: time.Millisecond}
+	err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"one", "two"} {
+		err := d.Publish(events.Event{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a failing host doesn't keep the event from the others
+	waitFor(t, "the healthy host", func() bool { return len(healthy.received()) == 2 })
+	waitFor(t, "the flaky host", func() bool { return len(flaky.received()) == 2 })
+	if got := flaky.received(); !slices.Contains(got, "one") || !slices.Contains(got, "two") {
+		t.Errorf("flaky host got %v, want one and two", got)
+	}
+	waitFor(t, "the deliveries to be counted", func() bool {
+		status := d.Status()
+		return status[0].Delivered == 2 && status[1].Delivered == 2
+	})
+	status := d.Status()
+	if status[0].Last_Error == "" || status[1].Last_Error != "" {
+		t.Errorf("Status() = %+v", status)
+	}
+}
+
+func TestDispatcherRetryDoesNotBlockHost(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		if e.Key == "bad" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e.Key)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &Dispatcher{Sinks: httpSinks(server.URL), Min_Backoff: time.Hour}
+	err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"bad", "one", "two"} {
+		err := d.Publish(events.Event{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the newer events go out while the one that failed waits for its retry
+	waitFor(t, "the newer events", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 2
+	})
+	waitFor(t, "the failed event to wait for its retry", func() bool { return d.Status()[0].Queued == 1 })
+	if status := d.Status()[0]; status.Delivered != 2 || status.Dead_Lettered != 0 || status.Last_Error == "" {
+		t.Errorf("Status() = %+v, want 2 delivered and 1 waiting to be retried", status)
+	}
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	d := &Dispatcher{Min_Backoff: time.Second, Max_Backoff: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{1000, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	down := newEventServer(t, -1, http.StatusBadGateway)
+	rejecting := newEventServer(t, -1, http.StatusBadRequest)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &Dispatcher{Sinks: httpSinks(down.URL, rejecting.URL), Max_Attempts: 3, Min_Backoff: time.Millisecond, Path: filepath.Join(t.TempDir(), "events.db")}
+	err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		d.Close()
+	}()
+
+	err = d.Publish(events.Event{Key: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "dead letters", func() bool { return d.DeadLetters() == 2 })
+
+	// a host that rejects the event isn't retried
+	if down.attemptCount() != 3 || rejecting.attemptCount() != 1 {
+		t.Errorf("got %d and %d attempts, want 3 and 1", down.attemptCount(), rejecting.attemptCount())
+	}
+	for _, status := range d.Status() {
+		if status.Dead_Lettered != 1 || status.Queued != 0 {
+			t.Errorf("Status() = %+v, want one dead letter", status)
+		}
+	}
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	d := &Dispatcher{Sinks: httpSinks("http://127.0.0.1:1"), Queue_Size: 2}
+
+	// nothing is sending, so the queue fills up
+	for i := 0; i < 2; i++ {
+		err := d.Publish(events.Event{Key: "queued"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.Publish(events.Event{Key: "dropped"})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Publish() = %v, want %v", err, ErrQueueFull)
+	}
+	if queued := d.Status()[0].Queued; queued != 2 {
+		t.Errorf("%d events queued, want 2", queued)
+	}
+}
+
+func TestDispatcherKeepsEventsOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	var down atomic.Bool
+	down.Store(true)
+	var mu sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e events.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		mu.Lock()
+		keys = append(keys, e.Key)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// the dispatcher is stopped while it is backing off from the first event
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{Sinks: httpSinks(server.URL), Path: path, Min_Backoff: time.Hour}
+	err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"one", "two"} {
+		err := d.Publish(events.Event{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the first attempt", func() bool { return d.Status()[0].Last_Error != "" })
+	cancel()
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host comes back after a restart
+	down.Store(false)
+	ctx, cancel = context.WithCancel(context.Background())
+	d = &Dispatcher{Sinks: httpSinks(server.URL), Path: path}
+	err = d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		d.Close()
+	}()
+
+	waitFor(t, "the queued events", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(keys) == 2
+	})
+	if keys[0] != "one" || keys[1] != "two" || d.DeadLetters() != 0 {
+		t.Errorf("got %v and %d dead letters, want [one two] and none", keys, d.DeadLetters())
+	}
+}
@@ -1,7 +1,7 @@
 package event
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,53 +12,152 @@ import (
 	"time"
 
 	"github.com/byuoitav/common/v2/events"
+
+	"github.com/byuoitav/workday-pi-time/config"
 )
 
+// ErrRejected is returned when a sink refuses an event in a way that sending it again won't fix
+var ErrRejected = errors.New("event rejected")
+
 var (
-	eventProcessorHost = os.Getenv("EVENT_PROCESSOR_HOST")
+	client = &http.Client{Timeout: 5 * time.Second}
+
+	// the dispatcher Publish uses - set up from the EVENT_* settings
+	dispatcher = &Dispatcher{}
 )
 
-func SendEvent(e events.Event) error {
-	if len(eventProcessorHost) == 0 {
-		return errors.New("no event hosts")
+// Setup reads the event settings. Events are only queued in memory until Start is called.
+func Setup() error {
+	var l config.Loader
+	sinks := sinksFromConfig(&l)
+	d := &Dispatcher{
+		Sinks:        sinks,
+		Queue_Size:   l.Int("EVENT_QUEUE_SIZE", 1000),
+		Max_Attempts: l.Int("EVENT_MAX_ATTEMPTS", 10),
+		Min_Backoff:  l.Duration("EVENT_RETRY_BACKOFF", time.Second),
+		Max_Backoff:  l.Duration("EVENT_RETRY_MAX_BACKOFF", 5*time.Minute),
+		Path:         l.Get("EVENT_QUEUE_PATH"),
 	}
-
-	// add generating system
-	e.GeneratingSystem = os.Getenv("SYSTEM_ID")
-
-	reqBody, err := json.Marshal(e)
+	client.Timeout = l.Duration("EVENT_TIMEOUT", 5*time.Second)
+	err := l.Err()
 	if err != nil {
-		return fmt.Errorf("unable to marshal event: %w", err)
+		return err
 	}
 
-	eventProcessorHostList := strings.Split(eventProcessorHost, ",")
-	for _, hostName := range eventProcessorHostList {
-		// create the request
-		slog.Debug(fmt.Sprintf("Sending event to address %s", hostName))
+	dispatcher = d
+	names := make([]string, 0, len(sinks))
+	for _, sink := range sinks {
+		names = append(names, sink.Name())
+	}
+	if len(sinks) == 0 {
+		slog.Warn("no EVENT_PROCESSOR_HOST, EVENT_CLOUDEVENTS_URL or EVENT_MQTT_BROKER, events will not be sent")
+	}
+	slog.Info("event settings", "sinks", names, "queueSize", d.Queue_Size, "maxAttempts", d.Max_Attempts, "queuePath", d.Path)
+	return nil
+}
 
-		req, err := http.NewRequest("POST", hostName, bytes.NewReader(reqBody))
-		if err != nil {
-			return fmt.Errorf("unable to build request: %w", err)
-		}
+// builds a sink for each EVENT_PROCESSOR_HOST and EVENT_CLOUDEVENTS_URL, and one for EVENT_MQTT_BROKER if it is set
+func sinksFromConfig(l *config.Loader) []Sink {
+	var sinks []Sink
+	for _, host := range splitList(l.Get("EVENT_PROCESSOR_HOST")) {
+		sinks = append(sinks, HTTPSink{URL: host})
+	}
 
-		// add headers
-		req.Header.Add("content-type", "application/json")
+	source, typePrefix := l.Get("EVENT_CLOUDEVENTS_SOURCE"), l.Get("EVENT_CLOUDEVENTS_TYPE_PREFIX")
+	for _, url := range splitList(l.Get("EVENT_CLOUDEVENTS_URL")) {
+		sinks = append(sinks, CloudEventsSink{URL: url, Source: source, Type_Prefix: typePrefix})
+	}
 
-		client := http.Client{
-			Timeout: 5 * time.Second,
+	if broker := l.Get("EVENT_MQTT_BROKER"); broker != "" {
+		m := &MQTTSink{
+			Broker:    broker,
+			Topic:     l.Get("EVENT_MQTT_TOPIC"),
+			Client_ID: l.Get("EVENT_MQTT_CLIENT_ID"),
+			Username:  l.Get("EVENT_MQTT_USERNAME"),
+			Password:  l.Get("EVENT_MQTT_PASSWORD"),
+			QoS:       1,
+		}
+		if m.Topic == "" {
+			m.Topic = "timeclock/events"
+		}
+		if m.Client_ID == "" {
+			m.Client_ID = "workday-pi-time-" + os.Getenv("SYSTEM_ID")
 		}
+		switch qos := l.Get("EVENT_MQTT_QOS"); qos {
+		case "":
+		case "0", "1", "2":
+			m.QoS = qos[0] - '0'
+		default:
+			l.Problem(fmt.Errorf("EVENT_MQTT_QOS must be 0, 1 or 2, not %q", qos))
+		}
+		sinks = append(sinks, m)
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("unable to do request: %w", err)
+	// events on disk are kept under the sink's name
+	seen := make(map[string]bool)
+	for _, sink := range sinks {
+		if seen[sink.Name()] {
+			l.Problem(fmt.Errorf("%s is configured as an event sink more than once", sink.Name()))
 		}
-		defer resp.Body.Close()
+		seen[sink.Name()] = true
+	}
+	return sinks
+}
 
-		// read the resp
-		if resp.StatusCode/100 != 2 {
-			return fmt.Errorf("bad statusCode %v", resp.StatusCode)
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
 	}
+	return list
+}
 
-	return nil
+// SetDispatcher changes the dispatcher Publish queues events on
+func SetDispatcher(d *Dispatcher) {
+	dispatcher = d
+}
+
+// Start sends published events in the background until ctx is done
+func Start(ctx context.Context) error {
+	return dispatcher.Start(ctx)
+}
+
+// Close stops sending events once the context given to Start is done
+func Close() error {
+	return dispatcher.Close()
+}
+
+// Publish queues an event for every event host without waiting for it to be sent
+func Publish(e events.Event) error {
+	return dispatcher.Publish(e)
+}
+
+// Send sends an event to every event host and waits for them to answer, queueing it for the hosts that
+// can't be reached
+func Send(ctx context.Context, e events.Event) ([]HostResult, error) {
+	return dispatcher.Send(ctx, e)
+}
+
+// Status returns how delivery is going for each event host
+func Status() []HostStatus {
+	return dispatcher.Status()
+}
+
+// fills in the generating system and timestamp, and returns the event with the JSON it is queued as
+func marshal(e events.Event) (events.Event, []byte, error) {
+	// add generating system
+	if e.GeneratingSystem == "" {
+		e.GeneratingSystem = os.Getenv("SYSTEM_ID")
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	reqBody, err := json.Marshal(e)
+	if err != nil {
+		return e, nil, fmt.Errorf("unable to marshal event: %w", err)
+	}
+	return e, reqBody, nil
 }
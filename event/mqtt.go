@@ -0,0 +1,95 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTSink publishes the events.Event JSON to a topic on an MQTT broker. It connects on the first event
+// and again whenever the connection is lost, leaving the retries to the dispatcher.
+type MQTTSink struct {
+	// Broker is like tcp://broker:1883 or ssl://broker:8883
+	Broker    string
+	Topic     string
+	Client_ID string
+	Username  string
+	Password  string
+	// QoS is 0, 1 or 2
+	QoS byte
+
+	mu     sync.Mutex
+	client mqtt.Client
+}
+
+func (m *MQTTSink) Name() string {
+	return m.Broker + "/" + m.Topic
+}
+
+func (m *MQTTSink) Send(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("%w: unable to marshal event: %s", ErrRejected, err)
+	}
+
+	c, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = wait(ctx, c.Publish(m.Topic, m.QoS, false, body))
+	if err != nil {
+		return fmt.Errorf("unable to publish event to %s: %w", m.Name(), err)
+	}
+	return nil
+}
+
+// returns a connected client, connecting it first if it isn't
+func (m *MQTTSink) connect(ctx context.Context) (mqtt.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client == nil {
+		opts := mqtt.NewClientOptions().
+			AddBroker(m.Broker).
+			SetClientID(m.Client_ID).
+			SetUsername(m.Username).
+			SetPassword(m.Password).
+			SetConnectTimeout(client.Timeout).
+			SetWriteTimeout(client.Timeout).
+			SetAutoReconnect(false)
+		m.client = mqtt.NewClient(opts)
+	}
+	if m.client.IsConnectionOpen() {
+		return m.client, nil
+	}
+
+	err := wait(ctx, m.client.Connect())
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", m.Broker, err)
+	}
+	return m.client, nil
+}
+
+// Close disconnects from the broker
+func (m *MQTTSink) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil && m.client.IsConnectionOpen() {
+		m.client.Disconnect(uint(time.Second / time.Millisecond))
+	}
+	return nil
+}
+
+func wait(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
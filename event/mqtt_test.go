@@ -0,0 +1,136 @@
+package event
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// a local MQTT 3.1.1 broker that accepts any client and keeps what is published to it
+type testBroker struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	published map[string][][]byte
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: listener, published: make(map[string][][]byte)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		_, err = io.ReadFull(r, packet)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			topicLength := int(binary.BigEndian.Uint16(packet))
+			topic := string(packet[2 : 2+topicLength])
+			payload := packet[2+topicLength:]
+			if qos := header >> 1 & 3; qos > 0 {
+				id := payload[:2]
+				payload = payload[2:]
+				conn.Write([]byte{0x40, 2, id[0], id[1]})
+			}
+			b.mu.Lock()
+			b.published[topic] = append(b.published[topic], payload)
+			b.mu.Unlock()
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *testBroker) messages(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published[topic]
+}
+
+func TestMQTTSink(t *testing.T) {
+	broker := newTestBroker(t)
+	sink := &MQTTSink{Broker: broker.url(), Topic: "timeclock/events", Client_ID: "test", QoS: 1}
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, key := range []string{"punch-accepted", "tcd-down"} {
+		err := sink.Send(ctx, events.Event{Key: key, GeneratingSystem: "ITB-1101-TC1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := broker.messages("timeclock/events")
+	if len(messages) != 2 {
+		t.Fatalf("broker got %d messages, want 2", len(messages))
+	}
+	var e events.Event
+	err := json.Unmarshal(messages[1], &e)
+	if err != nil || e.Key != "tcd-down" || e.GeneratingSystem != "ITB-1101-TC1" {
+		t.Errorf("got %s, want the tcd-down event", messages[1])
+	}
+}
+
+func TestMQTTSinkBrokerDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	sink := &MQTTSink{Broker: "tcp://" + addr, Topic: "timeclock/events", Client_ID: "test", QoS: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sink.Send(ctx, events.Event{Key: "punch-accepted"}); err == nil {
+		t.Fatal("Send() succeeded with the broker down")
+	}
+}
@@ -0,0 +1,125 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// Sink delivers events to one destination
+type Sink interface {
+	// Name identifies the sink in logs and delivery results, like its URL
+	Name() string
+	// Send delivers one event, returning an error wrapping ErrRejected if sending it again won't help
+	Send(ctx context.Context, e events.Event) error
+}
+
+// HTTPSink posts the events.Event JSON to an event processor
+type HTTPSink struct {
+	URL string
+}
+
+func (h HTTPSink) Name() string {
+	return h.URL
+}
+
+func (h HTTPSink) Send(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("%w: unable to marshal event: %s", ErrRejected, err)
+	}
+	return post(ctx, h.URL, "application/json", body)
+}
+
+// CloudEventsSink posts events as structured mode CloudEvents 1.0, with the events.Event as the data
+type CloudEventsSink struct {
+	URL string
+	// Source defaults to /workday-pi-time/ and the event's generating system
+	Source string
+	// Type_Prefix goes in front of the event's key to make the CloudEvent type, defaults to edu.byu.av.timeclock
+	Type_Prefix string
+}
+
+type cloudEvent struct {
+	Spec_Version      string       `json:"specversion"`
+	ID                string       `json:"id"`
+	Source            string       `json:"source"`
+	Type              string       `json:"type"`
+	Subject           string       `json:"subject,omitempty"`
+	Time              time.Time    `json:"time"`
+	Data_Content_Type string       `json:"datacontenttype"`
+	Data              events.Event `json:"data"`
+}
+
+func (c CloudEventsSink) Name() string {
+	return c.URL
+}
+
+func (c CloudEventsSink) Send(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(c.cloudEvent(e))
+	if err != nil {
+		return fmt.Errorf("%w: unable to marshal cloud event: %s", ErrRejected, err)
+	}
+	return post(ctx, c.URL, "application/cloudevents+json", body)
+}
+
+func (c CloudEventsSink) cloudEvent(e events.Event) cloudEvent {
+	source := c.Source
+	if source == "" {
+		source = "/workday-pi-time/" + e.GeneratingSystem
+	}
+	typePrefix := c.Type_Prefix
+	if typePrefix == "" {
+		typePrefix = "edu.byu.av.timeclock"
+	}
+
+	// the id comes from the event itself so a retried event keeps its id and receivers can drop duplicates
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+
+	return cloudEvent{
+		Spec_Version:      "1.0",
+		ID:                hex.EncodeToString(sum[:16]),
+		Source:            source,
+		Type:              typePrefix + "." + e.Key,
+		Subject:           e.TargetDevice.DeviceID,
+		Time:              e.Timestamp,
+		Data_Content_Type: "application/json",
+		Data:              e,
+	}
+}
+
+func post(ctx context.Context, hostName string, contentType string, body []byte) error {
+	slog.Debug(fmt.Sprintf("Sending event to address %s", hostName))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hostName, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: unable to build request for %s: %s", ErrRejected, hostName, err)
+	}
+	req.Header.Add("content-type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send event to %s: %w", hostName, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s answered %v", ErrRejected, hostName, resp.StatusCode)
+	default:
+		return fmt.Errorf("bad statusCode %v from %s", resp.StatusCode, hostName)
+	}
+}
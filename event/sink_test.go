@@ -0,0 +1,95 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+
+	"github.com/byuoitav/workday-pi-time/config"
+)
+
+func TestCloudEventsSink(t *testing.T) {
+	var got []cloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/cloudevents+json" {
+			t.Errorf("Content-Type = %q, want application/cloudevents+json", ct)
+		}
+		var ce cloudEvent
+		err := json.NewDecoder(r.Body).Decode(&ce)
+		if err != nil {
+			t.Errorf("bad cloud event: %s", err)
+		}
+		got = append(got, ce)
+	}))
+	defer server.Close()
+
+	e := events.Event{
+		GeneratingSystem: "ITB-1101-TC1",
+		Timestamp:        time.Date(2024, 3, 12, 8, 0, 0, 0, time.UTC),
+		TargetDevice:     events.GenerateBasicDeviceInfo("ITB-1101-TC1"),
+		Key:              "punch-accepted",
+		Value:            "IN",
+	}
+	sink := CloudEventsSink{URL: server.URL}
+	for i := 0; i < 2; i++ {
+		err := sink.Send(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d cloud events, want 2", len(got))
+	}
+	ce := got[0]
+	if ce.Spec_Version != "1.0" || ce.Type != "edu.byu.av.timeclock.punch-accepted" || ce.Source != "/workday-pi-time/ITB-1101-TC1" || ce.Subject != "ITB-1101-TC1" || !ce.Time.Equal(e.Timestamp) {
+		t.Errorf("got cloud event %+v", ce)
+	}
+	if ce.Data.Key != e.Key || ce.Data.Value != e.Value {
+		t.Errorf("got data %+v, want the event", ce.Data)
+	}
+	// a retried event keeps its id
+	if ce.ID == "" || got[1].ID != ce.ID {
+		t.Errorf("got ids %q and %q, want the same id", ce.ID, got[1].ID)
+	}
+}
+
+func TestSinksFromConfig(t *testing.T) {
+	t.Setenv("EVENT_PROCESSOR_HOST", "http://processor-1/event, http://processor-2/event")
+	t.Setenv("EVENT_CLOUDEVENTS_URL", "https://campus-bus/events")
+	t.Setenv("EVENT_MQTT_BROKER", "tcp://broker:1883")
+	t.Setenv("EVENT_MQTT_QOS", "0")
+
+	var l config.Loader
+	sinks := sinksFromConfig(&l)
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, sink := range sinks {
+		names = append(names, sink.Name())
+	}
+	want := "http://processor-1/event http://processor-2/event https://campus-bus/events tcp://broker:1883/timeclock/events"
+	if strings.Join(names, " ") != want {
+		t.Errorf("got sinks %q, want %q", names, want)
+	}
+	if m, ok := sinks[3].(*MQTTSink); !ok || m.QoS != 0 {
+		t.Errorf("got %+v, want an MQTT sink with QoS 0", sinks[3])
+	}
+
+	t.Setenv("EVENT_CLOUDEVENTS_URL", "http://processor-1/event")
+	t.Setenv("EVENT_MQTT_QOS", "3")
+	l = config.Loader{}
+	sinksFromConfig(&l)
+	var validation *config.ValidationError
+	if !errors.As(l.Err(), &validation) || len(validation.Problems) != 2 {
+		t.Errorf("Err() = %v, want problems with the duplicate sink and the QoS", l.Err())
+	}
+}
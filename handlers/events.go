@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/gin-gonic/gin"
+
+	"github.com/byuoitav/workday-pi-time/config"
+	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/event"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// Keys of the events the handlers publish
+const (
+	EventLogin         = "employee-login"
+	EventPunchAccepted = "punch-accepted"
+	EventPunchQueued   = "punch-queued"
+	EventPunchRejected = "punch-rejected"
+	EventUnknownWorker = "unknown-worker"
+	EventTCDDown       = "tcd-down"
+	EventWorkdayDown   = "workday-down"
+)
+
+// tag on every event the timeclock publishes, so the monitoring stack can pick them out
+const TimeclockTag = "timeclock"
+
+// the clock the events are about, with its building and room taken from a hostname like ITB-1101-TC1
+var device events.BasicDeviceInfo
+
+// bearer token callers other than this clock send to POST /event - set with EVENT_AUTH_TOKEN
+var eventToken atomic.Pointer[string]
+
+func init() {
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("unable to get hostname for events", "error", err)
+	}
+	device = events.GenerateBasicDeviceInfo(hostname)
+
+	token, err := config.Get("EVENT_AUTH_TOKEN")
+	if err != nil {
+		slog.Error("can not read EVENT_AUTH_TOKEN, only this clock can send events", "error", err)
+	}
+	eventToken.Store(&token)
+	config.Watch("EVENT_AUTH_TOKEN", func(token string) {
+		eventToken.Store(&token)
+	})
+}
+
+// LocalOrToken only lets requests from this clock through, unless they have EVENT_AUTH_TOKEN as a bearer token
+func LocalOrToken(c *gin.Context) {
+	// RemoteAddr rather than ClientIP, which would believe an X-Forwarded-For header
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		c.Next()
+		return
+	}
+
+	token := *eventToken.Load()
+	if token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) == 1 {
+		c.Next()
+		return
+	}
+	slog.Warn("refused request from another host", "path", c.Request.URL.Path, "remote_addr", c.Request.RemoteAddr)
+	c.AbortWithStatusJSON(http.StatusForbidden, "only this clock, or a caller with the event token, can do that")
+}
+
+// checks an event sent to POST /event
+func validateEvent(e events.Event) error {
+	var problems []string
+	switch {
+	case strings.TrimSpace(e.Key) == "":
+		problems = append(problems, "key is required")
+	case len(e.Key) > 256:
+		problems = append(problems, "key must be 256 characters or less")
+	}
+	if len(e.Value) > 4096 {
+		problems = append(problems, "value must be 4096 characters or less")
+	}
+	for _, tag := range e.EventTags {
+		if strings.TrimSpace(tag) == "" {
+			problems = append(problems, "event-tags can not be empty")
+			break
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid event: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// publishes an event about this clock without waiting for it to be sent
+func publishEvent(key string, value string, user string, data map[string]string, tags ...string) {
+	e := events.Event{
+		Timestamp:    time.Now(),
+		EventTags:    append([]string{TimeclockTag}, tags...),
+		TargetDevice: device,
+		AffectedRoom: device.BasicRoomInfo,
+		Key:          key,
+		Value:        value,
+		User:         user,
+	}
+	if len(data) > 0 {
+		e.Data = data
+	}
+	err := event.Publish(e)
+	if err != nil {
+		slog.Warn("unable to publish event", "key", key, "error", err)
+	}
+}
+
+// publishes tcd-down, or unknown-worker if the TCD answered but doesn't know the worker
+func publishTCDError(byuID string, operation string, err error) {
+	if errors.Is(err, database.ErrWorkerNotFound) {
+		publishEvent(EventUnknownWorker, byuID, byuID, map[string]string{"source": "tcd"}, events.UserGenerated)
+		return
+	}
+	publishEvent(EventTCDDown, err.Error(), byuID, map[string]string{"operation": operation}, events.Error, events.AutoGenerated)
+}
+
+// publishes workday-down, or unknown-worker if Workday answered but doesn't know the worker
+func publishWorkdayError(byuID string, operation string, err error) {
+	if errors.Is(err, workday.ErrInvalidWorker) || errors.Is(err, database.ErrReportWorkerNotFound) {
+		publishEvent(EventUnknownWorker, byuID, byuID, map[string]string{"source": "workday"}, events.UserGenerated)
+		return
+	}
+	data := map[string]string{"operation": operation}
+	for _, s := range workdayErrorStatus {
+		if errors.Is(err, s.kind) {
+			data["status"] = s.key
+			break
+		}
+	}
+	publishEvent(EventWorkdayDown, err.Error(), byuID, data, events.Error, events.AutoGenerated)
+}
+
+// the event data for a punch
+func punchEventData(punch database.Punch) map[string]string {
+	data := map[string]string{
+		"position_number":  punch.Position_Number,
+		"clock_event_type": punch.Clock_Event_Type,
+		"time_entry_code":  punch.Time_Entry_Code,
+		"punch_time":       punch.Time_Clock_Event_Date_Time.Format(time.RFC3339),
+	}
+	if punch.Punch_ID != "" {
+		data["punch_id"] = punch.Punch_ID
+	}
+	return data
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/event"
+	"github.com/byuoitav/workday-pi-time/offline"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// sends published events to a local event processor, and any other hosts, and returns the events it has received
+func captureEvents(t *testing.T, hosts ...string) func(n int) []events.Event {
+	t.Helper()
+	var mu sync.Mutex
+	var received []events.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		err := json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			t.Errorf("bad event: %s", err)
+		}
+		mu.Lock()
+		received = append(received, e)
+		mu.Unlock()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sinks := []event.Sink{event.HTTPSink{URL: server.URL}}
+	for _, host := range hosts {
+		sinks = append(sinks, event.HTTPSink{URL: host})
+	}
+	d := &event.Dispatcher{Sinks: sinks, Min_Backoff: time.Hour}
+	event.SetDispatcher(d)
+	err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		d.Close()
+		server.Close()
+		event.SetDispatcher(&event.Dispatcher{})
+	})
+
+	return func(n int) []events.Event {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]events.Event(nil), received...)
+			mu.Unlock()
+			if len(got) >= n || time.Now().After(deadline) {
+				return got
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	return database.PunchResponse{}, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+// a TCD that is up but refuses every punch
+type rejectingWriter struct{}
+
+func (rejectingWriter) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	return database.PunchResponse{}, fmt.Errorf("error inserting punch into timeevents: %w", &pq.Error{Code: "23502", Message: "null value in column \"position_id\""})
+}
+
+func postPunch(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	return sendPunch(t, database.Punch{Worker_ID: "123456789", Position_Number: "P1", Clock_Event_Type: "IN", Time_Entry_Code: "TC1"})
+}
+
+func TestPostPunchPublishesEvents(t *testing.T) {
+	received := captureEvents(t)
+	SetStore(database.NewMemoryStore())
+	defer SetStore(nil)
+
+	if w := postPunch(t); w.Code != http.StatusOK {
+		t.Fatalf("PostPunch returned %d: %s", w.Code, w.Body)
+	}
+	got := received(1)
+	if len(got) != 1 || got[0].Key != EventPunchAccepted || got[0].User != "123456789" || got[0].Value != "IN" {
+		t.Fatalf("got events %+v, want one %s", got, EventPunchAccepted)
+	}
+	if !events.ContainsAllTags(got[0], TimeclockTag, events.UserGenerated) || got[0].TargetDevice != device {
+		t.Errorf("event %+v is missing its tags or device", got[0])
+	}
+
+	// the TCD is down, so the punch is queued
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+	SetPunchWriter(failingWriter{})
+	defer SetPunchWriter(nil)
+
+	w := sendPunch(t, database.Punch{Worker_ID: "123456789", Position_Number: "P1", Clock_Event_Type: "OUT", Time_Entry_Code: "TC1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("PostPunch returned %d: %s", w.Code, w.Body)
+	}
+	got = received(3)
+	if len(got) != 3 || got[1].Key != EventTCDDown || got[2].Key != EventPunchQueued {
+		t.Errorf("got events %+v, want %s then %s", got[1:], EventTCDDown, EventPunchQueued)
+	}
+}
+
+func TestPostPunchRejected(t *testing.T) {
+	received := captureEvents(t)
+	SetStore(database.NewMemoryStore())
+	defer SetStore(nil)
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+	SetPunchWriter(rejectingWriter{})
+	defer SetPunchWriter(nil)
+
+	if w := postPunch(t); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("PostPunch returned %d: %s, want %d", w.Code, w.Body, http.StatusUnprocessableEntity)
+	}
+	if n := offline.Count(offline.PENDING_BUCKET); n != 0 {
+		t.Errorf("got %d queued punches, want the rejected punch left out of the queue", n)
+	}
+	got := received(1)
+	if len(got) != 1 || got[0].Key != EventPunchRejected {
+		t.Errorf("got events %+v, want one %s", got, EventPunchRejected)
+	}
+}
+
+func TestUnknownWorkerPublishesEvent(t *testing.T) {
+	received := captureEvents(t)
+	SetStore(database.NewMemoryStore())
+	defer SetStore(nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/get_employee_data/:id", GetEmployeeData)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get_employee_data/987654321", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GetEmployeeData returned %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	got := received(1)
+	if len(got) != 1 || got[0].Key != EventUnknownWorker || got[0].Value != "987654321" {
+		t.Errorf("got events %+v, want one %s", got, EventUnknownWorker)
+	}
+}
+
+func TestPublishWorkdayError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"worker not in the report", &database.ReportError{Status: http.StatusOK, Kind: database.ErrReportWorkerNotFound}, EventUnknownWorker},
+		{"invalid worker fault", fmt.Errorf("get calculated time blocks: %w", workday.ErrInvalidWorker), EventUnknownWorker},
+		{"report not found", &database.ReportError{Status: http.StatusNotFound, Kind: database.ErrReportNotFound}, EventWorkdayDown},
+		{"report maintenance page", &database.ReportError{Status: http.StatusOK, Kind: database.ErrReportMaintenance}, EventWorkdayDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := captureEvents(t)
+			publishWorkdayError("123456789", "get_time_sheet", tt.err)
+			got := received(1)
+			if len(got) != 1 || got[0].Key != tt.want {
+				t.Errorf("got events %+v, want one %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendEventHandler(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	received := captureEvents(t, down.URL)
+	t.Setenv("SYSTEM_ID", "ITB-1101-TC1")
+	token := "s3cret"
+	eventToken.Store(&token)
+	defer func() {
+		token := ""
+		eventToken.Store(&token)
+	}()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/event", LocalOrToken, SendEventHandler)
+	send := func(remoteAddr string, authorization string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/event", bytes.NewReader([]byte(body)))
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("192.0.2.10:4321", "", `{"key": "button-press"}`); w.Code != http.StatusForbidden {
+		t.Errorf("another host without the token got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := send("192.0.2.10:4321", "Bearer wrong", `{"key": "button-press"}`); w.Code != http.StatusForbidden {
+		t.Errorf("another host with the wrong token got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := send("127.0.0.1:4321", "", `{"value": "no key"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("an event without a key got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := send("127.0.0.1:4321", "", `{"key": `); w.Code != http.StatusBadRequest {
+		t.Errorf("bad JSON got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// one host gets the event and the other, which is down, has it queued
+	w := send("192.0.2.10:4321", "Bearer s3cret", `{"key": "button-press", "value": "help", "event-tags": ["ui-event"]}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s, want %d", w.Code, w.Body, http.StatusAccepted)
+	}
+	var response SendEventResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Hosts) != 2 || response.Hosts[0].Status != event.Delivered || response.Hosts[1].Status != event.Queued || response.Hosts[1].Host != down.URL {
+		t.Errorf("got hosts %+v, want delivered then queued", response.Hosts)
+	}
+
+	got := received(1)
+	if len(got) != 1 || got[0].Key != "button-press" || got[0].GeneratingSystem != "ITB-1101-TC1" || got[0].Timestamp.IsZero() {
+		t.Errorf("got events %+v, want button-press with the generating system and timestamp filled in", got)
+	}
+}
@@ -1,28 +1,102 @@
 package handlers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/workday-pi-time/clockstate"
+	"github.com/byuoitav/workday-pi-time/config"
 	"github.com/byuoitav/workday-pi-time/database"
 	"github.com/byuoitav/workday-pi-time/event"
+	"github.com/byuoitav/workday-pi-time/offline"
+	"github.com/byuoitav/workday-pi-time/workday"
 
 	"github.com/gin-gonic/gin"
 )
 
+// the TCD the handlers read from and write punches to
+var store database.TCDStore
+
+// total time a kiosk login has to gather the employee's data - set with LOGIN_TIMEOUT
+var loginTimeout = 15 * time.Second
+
+// how long a position can be clocked in before it is reported as missing an OUT - set with MISSING_OUT_THRESHOLD
+var missingOutAfter = 12 * time.Hour
+
+// what PostPunch does with a punch that contradicts the position's clock state - set with PUNCH_CONFLICT_MODE.
+// confirm (the default) refuses it unless it is resent with confirm set, reject always refuses it, and off
+// skips the check.
+var punchConflictMode = "confirm"
+
+// how far the punch time a kiosk sends can be from the server's clock - set with PUNCH_CLOCK_SKEW
+var punchClockSkew = 5 * time.Minute
+
+// total time a punch has to be looked up, checked and written or queued - set with PUNCH_TIMEOUT
+var punchTimeout = 10 * time.Second
+
+// recent Workday time sheets - set with EMPLOYEE_CACHE_TTL, EMPLOYEE_CACHE_REVALIDATE and EMPLOYEE_CACHE_MAX_STALE
+var timeSheets = database.NewTimeSheetCache(5*time.Minute, 10*time.Minute, 24*time.Hour)
+
+// Setup reads the login, punch and time sheet cache settings, returning everything wrong with them at once.
+// Nothing is changed unless they are all valid.
+func Setup() error {
+	var l config.Loader
+	login := l.Duration("LOGIN_TIMEOUT", 15*time.Second)
+	missingOut := l.Duration("MISSING_OUT_THRESHOLD", 12*time.Hour)
+	skew := l.Duration("PUNCH_CLOCK_SKEW", 5*time.Minute)
+	timeout := l.Duration("PUNCH_TIMEOUT", 10*time.Second)
+	mode := l.Get("PUNCH_CONFLICT_MODE")
+	switch mode {
+	case "":
+		mode = "confirm"
+	case "confirm", "reject", "off":
+	default:
+		l.Problem(fmt.Errorf("PUNCH_CONFLICT_MODE must be confirm, reject or off, not %q", mode))
+	}
+	// a TTL of 0 turns the cache off
+	ttl := l.DurationAtLeast("EMPLOYEE_CACHE_TTL", 5*time.Minute, 0)
+	revalidate := l.DurationAtLeast("EMPLOYEE_CACHE_REVALIDATE", 10*time.Minute, 0)
+	maxStale := l.DurationAtLeast("EMPLOYEE_CACHE_MAX_STALE", 24*time.Hour, 0)
+
+	err := l.Err()
+	if err != nil {
+		return err
+	}
+	loginTimeout, missingOutAfter, punchClockSkew, punchTimeout, punchConflictMode = login, missingOut, skew, timeout, mode
+	timeSheets = database.NewTimeSheetCache(ttl, revalidate, maxStale)
+	return nil
+}
+
+// SetStore sets the TCDStore used by the handlers
+func SetStore(s database.TCDStore) {
+	store = s
+}
+
+// where PostPunch sends punches, the TCD store unless SetPunchWriter was called
+var punchWriter offline.PunchWriter
+
+// SetPunchWriter sends punches somewhere other than the TCD, e.g. straight to Workday
+func SetPunchWriter(w offline.PunchWriter) {
+	punchWriter = w
+}
+
 // Returns data from the postgres database - aka the TCD
-func GetEmployeeFromTCD(context *gin.Context, employee *database.Employee) (bool, error) {
+func GetEmployeeFromTCD(ctx context.Context, byuID string, employee *database.Employee) (bool, error) {
 	online := true
-	byuID := context.Param("id")
 	slog.Debug("GetEmployeeFromTCD with byuID: " + byuID)
 
 	// get the employee info for this worker
-	err := database.GetWorkerInfo(byuID, employee)
+	err := database.GetWorkerInfo(ctx, store, byuID, employee)
 	if err != nil {
 		online = false
 		slog.Error("unable to GetWorkerInfo", "error", err)
@@ -32,116 +106,487 @@ func GetEmployeeFromTCD(context *gin.Context, employee *database.Employee) (bool
 	return online, nil
 }
 
-// Attempts to get data from the Workday custom API - returns
-func GetEmployeeFromWorkdayAPI(context *gin.Context, employee *database.Employee) (bool, error) {
-	// //get the id
+// Attempts to get data from the Workday custom API, using the time sheet cache when it can - returns
+// whether Workday was online and whether the data on employee is a stale copy from the cache
+func GetEmployeeFromWorkdayAPI(ctx context.Context, byuID string, employee *database.Employee) (bool, bool, error) {
 	online := true
-	byuID := context.Param("id")
 	slog.Debug("GetEmployeeFromWorkdayAPI with byuID: " + byuID)
 
+	cached, state := timeSheets.Get(employee.Worker_ID)
+	switch state {
+	case database.CacheFresh:
+		slog.Debug("using cached time sheet", "id", byuID, "fetched_at", cached.Fetched_At)
+		cached.Apply(employee)
+		return online, false, nil
+	case database.CacheRevalidate:
+		slog.Debug("using cached time sheet while it is refreshed", "id", byuID, "fetched_at", cached.Fetched_At)
+		go refreshTimeSheet(context.WithoutCancel(ctx), byuID, copyEmployee(employee))
+		cached.Apply(employee)
+		return online, false, nil
+	}
+
 	// //get the timesheet for this guy
-	err := database.GetTimeSheet(byuID, employee)
+	fetched := copyEmployee(employee)
+	err := database.GetTimeSheet(ctx, byuID, &fetched)
 	if err != nil {
 		online = false
 		slog.Error("unable to GetTimeSheet", "error", err)
-		return online, err
+		if state == database.CacheStale {
+			slog.Warn("using stale cached time sheet", "id", byuID, "fetched_at", cached.Fetched_At)
+			cached.Apply(employee)
+			return online, true, err
+		}
+		*employee = fetched
+		return online, false, err
 	}
+	timeSheets.Put(employee.Worker_ID, database.TimeSheetFromEmployee(&fetched))
+	*employee = fetched
 	slog.Info("GetEmployeeFromWorkdayAPI success", "response", online, "id", byuID)
-	return online, nil
+	return online, false, nil
 }
 
-// adds in any punches from the TCD that have not been uploaded to Workday - uses employee.Worker_ID - must be defined before running
-func GetEmployeePunchesFromTCD(context *gin.Context, employee *database.Employee) (int, bool, error) {
+// fetches a new copy of a cached time sheet in the background
+func refreshTimeSheet(ctx context.Context, byuID string, employee database.Employee) {
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+
+	err := database.GetTimeSheet(ctx, byuID, &employee)
+	if err != nil {
+		slog.Warn("unable to refresh cached time sheet", "id", byuID, "error", err)
+		timeSheets.RevalidateFailed(employee.Worker_ID)
+		return
+	}
+	timeSheets.Put(employee.Worker_ID, database.TimeSheetFromEmployee(&employee))
+	slog.Debug("refreshed cached time sheet", "id", byuID)
+}
+
+// copies an employee so it can be filled in without touching the original's positions
+func copyEmployee(employee *database.Employee) database.Employee {
+	employeeCopy := *employee
+	employeeCopy.Positions = slices.Clone(employee.Positions)
+	return employeeCopy
+}
+
+// returns any punches from the TCD that have not been uploaded to Workday
+func GetEmployeePunchesFromTCD(ctx context.Context, workerID string, positions []database.Position) ([]database.PeriodPunches, bool, error) {
 	online := true
-	// //get the current punches for employee.Worker_ID
-	count, err := database.GetRecentEmployeePunches(employee)
+	punches, err := database.GetPendingPeriodPunches(ctx, store, workerID, positions)
 	if err != nil {
 		online = false
-		slog.Error("unable to GetRecentEmployeePunches", "error", err)
-		return count, online, err
+		slog.Error("unable to GetPendingPeriodPunches", "error", err)
+		return punches, online, err
 	}
-	slog.Info("GetEmployeePunchesFromTCD success", "response", online, "worker_id", employee.Worker_ID)
-	return count, online, nil
+	slog.Info("GetEmployeePunchesFromTCD success", "response", online, "worker_id", workerID)
+	return punches, online, nil
 }
-func DetermineIfClockedIn(period_blocks *[]database.PeriodBlocks, period_punches *[]database.PeriodPunches, employee *database.Employee) error {
-	var errRtn error
-	for k := range employee.Positions {
-		employee.Positions[k].Clocked_In = "false"
-
-		//find latest clock in
-		var lastIn time.Time
-		//find latest block
-		for _, v := range *period_blocks {
-			if (v.Time_Clock_Event_Date_Time_IN == "N/A" || v.Time_Clock_Event_Date_Time_IN == "") || employee.Positions[k].Position_Number != v.Position_Number {
-				continue
-			}
-			blockStartTime, err := time.Parse("2006-01-02T15:04:05-07:00", v.Time_Clock_Event_Date_Time_IN)
-			if err != nil {
-				errRtn = errors.Join(errRtn, err)
-				continue
-			}
-			if blockStartTime.After(lastIn) {
-				lastIn = blockStartTime
+
+// status keys that say how workday failed, for the errors from the custom reports and the SOAP fallback
+var workdayErrorStatus = []struct {
+	kind error
+	key  string
+}{
+	{database.ErrReportAuthentication, "workday_auth_failed"},
+	{workday.ErrAuthentication, "workday_auth_failed"},
+	{database.ErrReportNotFound, "workday_not_found"},
+	{database.ErrReportWorkerNotFound, "workday_not_found"},
+	{workday.ErrInvalidWorker, "workday_not_found"},
+	{database.ErrReportThrottled, "workday_throttled"},
+	{workday.ErrRateLimited, "workday_throttled"},
+	{database.ErrReportMaintenance, "workday_maintenance"},
+	{workday.ErrServer, "workday_maintenance"},
+	{database.ErrReportRejected, "workday_rejected"},
+	{workday.ErrValidation, "workday_rejected"},
+	{database.ErrReportPayload, "workday_bad_payload"},
+}
+
+// the data returned to the UI for /get_employee_data
+type EmployeeDataResponse struct {
+	Status        map[string]bool   `json:"status"`
+	Error         []string          `json:"error"`
+	Events_In_TCD int               `json:"unprocessed_punches_in_tcd"`
+	Employee      database.Employee `json:"employee"`
+}
+
+// GetEmployeeData gets and returns all info to the UI for an employee. Once the worker is found in
+// the TCD employee cache, Workday and the TCD timeevents are queried at the same time. Whatever has
+// finished when loginTimeout elapses is returned, and anything else is reported offline.
+func GetEmployeeData(c *gin.Context) {
+	var employee database.Employee
+	var return_data EmployeeDataResponse
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), loginTimeout)
+	defer cancel()
+	byuID := c.Param("id")
+
+	status := make(map[string]bool)
+	errSend := make(map[string]string)
+	online, err := GetEmployeeFromTCD(ctx, byuID, &employee)
+	if err != nil {
+		publishTCDError(byuID, "get_worker", err)
+		errSend["error"] = err.Error()
+		c.JSON(http.StatusServiceUnavailable, errSend)
+		return
+	}
+
+	// workday fills in its own copy of the employee so nothing it is still writing is returned if it runs out of time
+	workdayEmployee := copyEmployee(&employee)
+	type workdayResult struct {
+		online bool
+		stale  bool
+		err    error
+	}
+	workdayDone := make(chan workdayResult, 1)
+	go func() {
+		online, stale, err := GetEmployeeFromWorkdayAPI(ctx, byuID, &workdayEmployee)
+		workdayDone <- workdayResult{online: online, stale: stale, err: err}
+	}()
+
+	type punchesResult struct {
+		punches []database.PeriodPunches
+		online  bool
+		err     error
+	}
+	punchesDone := make(chan punchesResult, 1)
+	go func(workerID string, positions []database.Position) {
+		punches, online, err := GetEmployeePunchesFromTCD(ctx, workerID, positions)
+		punchesDone <- punchesResult{punches: punches, online: online, err: err}
+	}(employee.Worker_ID, employee.Positions)
+
+	var online2, online3, stale bool
+	var workdayErr error
+	var punches []database.PeriodPunches
+	for workdayDone != nil || punchesDone != nil {
+		select {
+		case result := <-workdayDone:
+			workdayDone = nil
+			online2 = result.online
+			stale = result.stale
+			workdayErr = result.err
+			if result.err != nil {
+				slog.Error("error with handlers.GetEmployeeFromWorkdayAPI ", "error", result.err)
+				publishWorkdayError(byuID, "get_time_sheet", result.err)
+				return_data.Error = append(return_data.Error, result.err.Error())
 			}
-		}
-		//find latest event
-		for _, v := range *period_punches {
-			if v.Clock_Event_Type != "Check-in" || employee.Positions[k].Position_Number != v.Position_Number {
-				continue
+			employee = workdayEmployee
+		case result := <-punchesDone:
+			punchesDone = nil
+			online3 = result.online
+			punches = result.punches
+			if result.err != nil {
+				slog.Error("error with handlers.GetEmployeePunchesFromTCD ", "error", result.err)
+				publishTCDError(byuID, "get_pending_punches", result.err)
+				return_data.Error = append(return_data.Error, result.err.Error())
 			}
-			eventTime, err := time.Parse("2006-01-02T15:04:05-07:00", v.Time_Clock_Event_Date_Time)
-			if err != nil {
-				errRtn = errors.Join(errRtn, err)
-				continue
+		case <-ctx.Done():
+			if workdayDone != nil {
+				slog.Error("timed out waiting for workday", "error", ctx.Err())
+				return_data.Error = append(return_data.Error, fmt.Sprintf("timed out waiting for workday: %s", ctx.Err()))
+				publishWorkdayError(byuID, "get_time_sheet", ctx.Err())
 			}
-			if eventTime.After(lastIn) {
-				lastIn = eventTime
+			if punchesDone != nil {
+				slog.Error("timed out waiting for TCD timeevents", "error", ctx.Err())
+				return_data.Error = append(return_data.Error, fmt.Sprintf("timed out waiting for TCD timeevents: %s", ctx.Err()))
+				publishTCDError(byuID, "get_pending_punches", ctx.Err())
 			}
+			workdayDone, punchesDone = nil, nil
 		}
+	}
+	employee.Period_Punches = append(employee.Period_Punches, punches...)
+	count := len(punches)
 
-		//find latest out
-		var lastOut time.Time
-		//find latest block
-		for _, v := range *period_blocks {
-			if (v.Time_Clock_Event_Date_Time_OUT == "N/A" || v.Time_Clock_Event_Date_Time_OUT == "") || employee.Positions[k].Position_Number != v.Position_Number {
-				continue
-			}
-			blockEndTime, err := time.Parse("2006-01-02T15:04:05-07:00", v.Time_Clock_Event_Date_Time_OUT)
-			if err != nil {
-				errRtn = errors.Join(errRtn, err)
-				continue
-			}
-			if blockEndTime.After(lastOut) {
-				lastOut = blockEndTime
-			}
+	err = DetermineIfClockedIn(&employee.Period_Blocks, &employee.Period_Punches, &employee)
+	if err != nil {
+		slog.Error("error with DetermineIfClockedIn ", "error", err)
+		return_data.Error = append(return_data.Error, err.Error())
+	}
+
+	status["TCD_employee_cache_online"] = online
+	status["workdayAPI_online"] = online2
+	status["TCD_timeevents_online"] = online3
+	status["workday_data_stale"] = stale
+	status["workday_time_blocks_fallback"] = employee.Time_Blocks_Source == database.TimeBlocksFromWebService
+	for _, s := range workdayErrorStatus {
+		status[s.key] = status[s.key] || errors.Is(workdayErr, s.kind)
+	}
+	if count > 0 {
+		status["unprocessed_punches_in_tcd"] = true
+	} else {
+		status["unprocessed_punches_in_tcd"] = false
+	}
+
+	return_data.Status = status
+	return_data.Employee = employee
+	return_data.Events_In_TCD = count
+
+	loginValue := "online"
+	if len(return_data.Error) > 0 {
+		loginValue = "degraded"
+	}
+	publishEvent(EventLogin, loginValue, byuID, nil, events.UserGenerated)
+	c.JSON(http.StatusOK, return_data)
+}
+
+// sets each position's clock state by replaying its time blocks and punches in order
+func DetermineIfClockedIn(period_blocks *[]database.PeriodBlocks, period_punches *[]database.PeriodPunches, employee *database.Employee) error {
+	var errRtn error
+	now := time.Now()
+	for k := range employee.Positions {
+		position := &employee.Positions[k]
+
+		events, err := positionEvents(position.Position_Number, *period_blocks, *period_punches)
+		errRtn = errors.Join(errRtn, err)
+
+		result := clockstate.Replay(events, now, missingOutAfter)
+		position.Clock_State = string(result.State)
+		position.Clocked_In = "false"
+		position.Clocked_In_Since = ""
+		if result.State.IsIn() {
+			position.Clocked_In = "true"
+			position.Clocked_In_Since = result.Since.Format("2006-01-02T15:04:05-07:00")
 		}
-		//find latest event
-		for _, v := range *period_punches {
-			if v.Clock_Event_Type != "Check-out" || employee.Positions[k].Position_Number != v.Position_Number {
-				continue
-			}
-			eventTime, err := time.Parse("2006-01-02T15:04:05-07:00", v.Time_Clock_Event_Date_Time)
-			if err != nil {
-				errRtn = errors.Join(errRtn, err)
-				continue
-			}
-			if eventTime.After(lastIn) {
-				lastOut = eventTime
-			}
+	}
+	return errRtn
+}
+
+// collects the check-ins and check-outs for a position from its time blocks and punches,
+// skipping any that can not be parsed
+func positionEvents(positionNumber string, blocks []database.PeriodBlocks, punches []database.PeriodPunches) ([]clockstate.Event, error) {
+	var events []clockstate.Event
+	var errRtn error
+
+	add := func(value string, in bool) {
+		if value == "" || value == "N/A" {
+			return
 		}
+		t, err := time.Parse("2006-01-02T15:04:05-07:00", value)
+		if err != nil {
+			errRtn = errors.Join(errRtn, fmt.Errorf("position %s: %w", positionNumber, err))
+			return
+		}
+		events = append(events, clockstate.Event{Time: t, In: in})
+	}
 
-		//compare latest in/out and update the value accordingly
-		if lastIn.After(lastOut) {
-			employee.Positions[k].Clocked_In = "true"
+	for _, v := range blocks {
+		if v.Position_Number != positionNumber {
+			continue
 		}
+		add(v.Time_Clock_Event_Date_Time_IN, true)
+		add(v.Time_Clock_Event_Date_Time_OUT, false)
+	}
+	for _, v := range punches {
+		if v.Position_Number != positionNumber {
+			continue
+		}
+		switch v.Clock_Event_Type {
+		case "Check-in":
+			add(v.Time_Clock_Event_Date_Time, true)
+		case "Check-out":
+			add(v.Time_Clock_Event_Date_Time, false)
+		}
+	}
+	return events, errRtn
+}
+
+// Codes returned in a PunchConflict
+const (
+	ConflictAlreadyClockedIn = "already_clocked_in"
+	ConflictNotClockedIn     = "not_clocked_in"
+)
+
+// PunchConflict is returned with a 409 when a punch contradicts the position's clock state
+type PunchConflict struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Clock_State string `json:"clock_state"`
+	// Confirm_Required is true when the punch will be accepted if it is resent with confirm set
+	Confirm_Required bool `json:"confirm_required"`
+}
+
+// compares a punch to the position's clock state, worked out from the cached time sheet plus the punches
+// in the TCD and offline queue that haven't made it to Workday yet. Without a cached time sheet the state
+// comes from those recent punches alone, since the latest of them says whether the worker is in. Returns
+// nil if the punch makes sense, if there is nothing to check it against, or if the recent punches can't be
+// read, since a half known state would flag punches that are fine.
+func checkPunch(ctx context.Context, store database.TCDStore, punch database.Punch) *PunchConflict {
+	if punchConflictMode == "off" {
+		return nil
+	}
+
+	var events []clockstate.Event
+	timeSheet, cached := timeSheets.Peek(punch.Worker_ID)
+	if cached {
+		var err error
+		events, err = positionEvents(punch.Position_Number, timeSheet.Period_Blocks, timeSheet.Period_Punches)
+		if err != nil {
+			slog.Warn("skipping unreadable events while checking punch", "error", err)
+		}
+	}
+
+	pending, err := store.PendingPunches(ctx, punch.Worker_ID)
+	if err != nil {
+		slog.Warn("unable to get TCD punches to check punch against", "error", err)
+		return nil
+	}
+	queued, err := offline.Pending(punch.Worker_ID)
+	if err != nil {
+		slog.Warn("unable to get queued punches to check punch against", "error", err)
+		return nil
+	}
+	recent := 0
+	for _, p := range append(pending, queued...) {
+		if p.Position_Number != punch.Position_Number {
+			continue
+		}
+		events = append(events, clockstate.Event{Time: p.Time_Clock_Event_Date_Time, In: p.Clock_Event_Type == "IN"})
+		recent++
+	}
+	if !cached && recent == 0 {
+		slog.Debug("no cached time sheet or recent punches to check punch against", "worker_id", punch.Worker_ID)
+		return nil
+	}
+
+	result := clockstate.Replay(events, time.Now(), missingOutAfter)
+	conflict := &PunchConflict{Clock_State: string(result.State), Confirm_Required: punchConflictMode == "confirm"}
+	switch {
+	case punch.Clock_Event_Type == "IN" && result.State.IsIn():
+		conflict.Code = ConflictAlreadyClockedIn
+		conflict.Message = "You have been clocked in to this job since " + result.Since.Local().Format("Jan 2 3:04 PM") + "."
+	case punch.Clock_Event_Type == "OUT" && !result.State.IsIn():
+		conflict.Code = ConflictNotClockedIn
+		conflict.Message = "You are not clocked in to this job."
+	default:
+		return nil
+	}
+	return conflict
+}
+
+// how long a punch refused as contradictory can be confirmed, however long the worker takes to answer
+const conflictConfirmWindow = time.Hour
+
+// the punches refused as contradictory, by punch_id, with the time each was made. A confirmed resend of
+// one keeps its original time, which can be further from the server's clock than PUNCH_CLOCK_SKEW by then.
+var (
+	conflictedMu sync.Mutex
+	conflicted   = make(map[string]time.Time)
+)
+
+func rememberConflict(punch database.Punch, now time.Time) {
+	if punch.Punch_ID == "" {
+		return
+	}
+	conflictedMu.Lock()
+	defer conflictedMu.Unlock()
+	for punchID, at := range conflicted {
+		if now.Sub(at) > conflictConfirmWindow {
+			delete(conflicted, punchID)
+		}
+	}
+	conflicted[punch.Punch_ID] = punch.Time_Clock_Event_Date_Time
+}
+
+// whether punch is the confirmed resend of a punch that was refused as contradictory, with the same time
+func confirmsConflict(punch database.Punch, now time.Time) bool {
+	if !punch.Confirm || punch.Punch_ID == "" {
+		return false
+	}
+	conflictedMu.Lock()
+	defer conflictedMu.Unlock()
+	at, ok := conflicted[punch.Punch_ID]
+	return ok && at.Equal(punch.Time_Clock_Event_Date_Time) && now.Sub(at) <= conflictConfirmWindow
+}
+
+// the format of the punch_id a kiosk sends with a punch
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// looks for a punch that was already recorded with punchID, in the offline queue, then with the punches
+// sent straight to Workday, and then the TCD.
+// If the TCD can't be read the punch is treated as new, and the TCD skips it later if it turns out to be there.
+func findPunch(ctx context.Context, store database.TCDStore, punchID string) (database.PunchResponse, bool) {
+	queued, ok, err := offline.Find(punchID)
+	if err != nil {
+		slog.Warn("unable to look for punch in the offline queue", "punch_id", punchID, "error", err)
+	}
+	if ok {
+		return queuedPunchResponse(queued), true
+	}
+
+	sent, ok, err := offline.Sent(punchID)
+	if err != nil {
+		slog.Warn("unable to look for punch in the punches sent to workday", "punch_id", punchID, "error", err)
+	}
+	if ok {
+		return sent, true
+	}
+
+	response, ok, err := store.FindPunch(ctx, punchID)
+	if err != nil {
+		slog.Warn("unable to look for punch in the TCD", "punch_id", punchID, "error", err)
+	}
+	return response, ok
+}
+
+// the TCD for a single punch request. Once a call fails because the TCD can't be reached the rest fail
+// straight away with the same error, so the punch is queued without waiting out a timeout for each call.
+type punchStore struct {
+	database.TCDStore
+	unreachable error
+}
+
+func (s *punchStore) check(err error) error {
+	if err != nil && offline.IsUnreachable(err) {
+		s.unreachable = err
+	}
+	return err
+}
+
+func (s *punchStore) FindPunch(ctx context.Context, punchID string) (database.PunchResponse, bool, error) {
+	if s.unreachable != nil {
+		return database.PunchResponse{}, false, s.unreachable
+	}
+	response, ok, err := s.TCDStore.FindPunch(ctx, punchID)
+	return response, ok, s.check(err)
+}
+
+func (s *punchStore) PendingPunches(ctx context.Context, workerID string) ([]database.Punch, error) {
+	if s.unreachable != nil {
+		return nil, s.unreachable
+	}
+	punches, err := s.TCDStore.PendingPunches(ctx, workerID)
+	return punches, s.check(err)
+}
+
+func (s *punchStore) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	if s.unreachable != nil {
+		return database.PunchResponse{}, s.unreachable
+	}
+	response, err := s.TCDStore.InsertPunch(ctx, punch)
+	return response, s.check(err)
+}
+
+// the context shared by everything a punch request sends to the TCD and Workday, so the kiosk hears back
+// within punchTimeout
+func punchContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, punchTimeout)
+}
+
+// the response for a punch waiting in the offline queue
+func queuedPunchResponse(punch database.Punch) database.PunchResponse {
+	return database.PunchResponse{
+		Punch_Time:       punch.Time_Clock_Event_Date_Time.Format(time.RFC1123Z),
+		Clock_Event_Type: punch.Clock_Event_Type,
+		Writen_To_TCD:    "false",
+		Queued:           "true",
 	}
-	return errRtn
 }
 
 // Punch adds an in or out punch as determined by the body sent
 func PostPunch(context *gin.Context) {
 	var err error
 	var incomingRequest database.Punch
+	receivedAt := time.Now()
+	ctx, cancel := punchContext(context.Request.Context())
+	defer cancel()
+	tcd := &punchStore{TCDStore: store}
 	worker_ID := context.Param("id")
 	slog.Debug("PostPunch with worker_ID: " + worker_ID)
 	if len(worker_ID) != 9 {
@@ -164,6 +609,12 @@ func PostPunch(context *gin.Context) {
 		context.String(http.StatusBadRequest, err.Error())
 		return
 	}
+	if incomingRequest.Clock_Event_Type != "IN" && incomingRequest.Clock_Event_Type != "OUT" {
+		err = fmt.Errorf("clock_event_type must be IN or OUT. clock_event_type received: %s", incomingRequest.Clock_Event_Type)
+		slog.Error("bad request", "error", err)
+		context.String(http.StatusBadRequest, err.Error())
+		return
+	}
 	hostname, err := os.Hostname()
 
 	incomingRequest.Comment = "Wall Clock Punch from: " + hostname
@@ -173,28 +624,145 @@ func PostPunch(context *gin.Context) {
 		context.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	response, err := database.WritePunch(incomingRequest)
-	if err != nil {
-		err = fmt.Errorf("error writing punch to database %w", err)
+	if incomingRequest.Punch_ID != "" {
+		if !uuidPattern.MatchString(incomingRequest.Punch_ID) {
+			err = fmt.Errorf("punch_id must be a UUID. punch_id received: %s", incomingRequest.Punch_ID)
+			slog.Error("bad request", "error", err)
+			context.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		incomingRequest.Punch_ID = strings.ToLower(incomingRequest.Punch_ID)
+
+		//a retry of a punch that was already recorded gets the original response back
+		if response, ok := findPunch(ctx, tcd, incomingRequest.Punch_ID); ok {
+			if response.Hostname == "" {
+				response.Hostname = hostname
+			}
+			slog.Info("postPunch replayed", "punch_id", incomingRequest.Punch_ID, "response", response)
+			context.JSON(http.StatusOK, response)
+			return
+		}
+	}
+
+	//the time the punch was made at the kiosk is the punch time, as long as the kiosk's clock agrees with ours
+	if incomingRequest.Time_Clock_Event_Date_Time.IsZero() {
+		incomingRequest.Time_Clock_Event_Date_Time = receivedAt
+	}
+	skew := receivedAt.Sub(incomingRequest.Time_Clock_Event_Date_Time)
+	if (skew > punchClockSkew || skew < -punchClockSkew) && !confirmsConflict(incomingRequest, receivedAt) {
+		err = fmt.Errorf("punch time %s is more than %s from the server time %s", incomingRequest.Time_Clock_Event_Date_Time.Format(time.RFC3339), punchClockSkew, receivedAt.Format(time.RFC3339))
 		slog.Error("bad request", "error", err)
 		context.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	response.Hostname = hostname
+	incomingRequest.Received_At = receivedAt
+
+	conflict := checkPunch(ctx, tcd, incomingRequest)
+	if conflict != nil && !(conflict.Confirm_Required && incomingRequest.Confirm) {
+		slog.Warn("punch contradicts clock state", "worker_id", incomingRequest.Worker_ID, "position", incomingRequest.Position_Number, "code", conflict.Code, "clock_state", conflict.Clock_State)
+		if conflict.Confirm_Required {
+			rememberConflict(incomingRequest, receivedAt)
+		}
+		context.JSON(http.StatusConflict, conflict)
+		return
+	}
+	if conflict != nil {
+		slog.Info("contradictory punch confirmed", "worker_id", incomingRequest.Worker_ID, "position", incomingRequest.Position_Number, "code", conflict.Code)
+	}
+
+	var writer offline.PunchWriter = tcd
+	if punchWriter != nil {
+		writer = punchWriter
+	}
+	response, err := writer.InsertPunch(ctx, incomingRequest)
+	if err != nil && offline.IsPermanent(err) {
+		//queueing a punch that was refused would only have it refused again later
+		slog.Error("punch was rejected", "worker_id", incomingRequest.Worker_ID, "error", err)
+		publishEvent(EventPunchRejected, err.Error(), incomingRequest.Worker_ID, punchEventData(incomingRequest), events.UserGenerated, events.Error)
+		context.String(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("error writing punch to database, adding to offline queue", "error", err)
+		if _, ok := writer.(database.WorkdayPunchWriter); ok {
+			publishWorkdayError(incomingRequest.Worker_ID, "insert_punch", err)
+		} else {
+			publishTCDError(incomingRequest.Worker_ID, "insert_punch", err)
+		}
+		queued, qerr := offline.Enqueue(incomingRequest)
+		if qerr != nil {
+			err = fmt.Errorf("error writing punch to database %w and unable to queue it offline: %w", err, qerr)
+			slog.Error("bad request", "error", err)
+			context.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		response = queuedPunchResponse(queued)
+		publishEvent(EventPunchQueued, queued.Clock_Event_Type, queued.Worker_ID, punchEventData(queued), events.UserGenerated)
+	} else {
+		//workday has no punch_id to look punches up by, so remember what it said for when the punch is retried
+		err = offline.Remember(incomingRequest, response)
+		if err != nil {
+			slog.Warn("unable to remember punch sent to workday", "punch_id", incomingRequest.Punch_ID, "error", err)
+		}
+		publishEvent(EventPunchAccepted, incomingRequest.Clock_Event_Type, incomingRequest.Worker_ID, punchEventData(incomingRequest), events.UserGenerated)
+	}
+	if response.Hostname == "" {
+		response.Hostname = hostname
+	}
+
+	//the cached time sheet no longer matches what is in Workday and the TCD
+	timeSheets.Invalidate(incomingRequest.Worker_ID)
 	slog.Info("postPunch success", "response", response)
 	context.JSON(http.StatusOK, response)
 }
 
-// SendEventHandler passes an event to the messenger
+// the response to POST /event, with what happened to the event at each event host
+type SendEventResponse struct {
+	Hosts []event.HostResult `json:"hosts"`
+}
+
+// SendEventHandler checks an event from the UI, or another caller with EVENT_AUTH_TOKEN, and sends it to
+// every event host. It answers 200 if every host got it, 202 if some hosts will get it once they are back,
+// and 502 if a host refused it or it couldn't be queued.
 func SendEventHandler(context *gin.Context) {
 	var e events.Event
-	if err := context.Bind(&e); err != nil {
-		context.JSON(http.StatusInternalServerError, err.Error())
+	context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, 64<<10)
+	err := context.ShouldBindJSON(&e)
+	if err != nil {
+		err = fmt.Errorf("error parsing event. error: %w", err)
+		slog.Error("bad request body", "error", err)
+		context.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = validateEvent(e)
+	if err != nil {
+		slog.Error("bad request", "error", err)
+		context.JSON(http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if err := event.SendEvent(e); err != nil {
+	results, err := event.Send(context.Request.Context(), e)
+	if err != nil {
+		slog.Error("unable to send event", "error", err)
 		context.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(results) == 0 {
+		context.JSON(http.StatusServiceUnavailable, "no event hosts")
+		return
 	}
 
-	context.JSON(http.StatusOK, "ok")
+	code := http.StatusOK
+	for _, result := range results {
+		switch result.Status {
+		case event.Failed:
+			code = http.StatusBadGateway
+		case event.Queued:
+			if code == http.StatusOK {
+				code = http.StatusAccepted
+			}
+		}
+	}
+	slog.Info("sendEvent", "key", e.Key, "hosts", results)
+	context.JSON(code, SendEventResponse{Hosts: results})
 }
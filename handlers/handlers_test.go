@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/byuoitav/workday-pi-time/config"
+	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/offline"
+	"github.com/byuoitav/workday-pi-time/paycalendar"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+// a store with one worker who has a single position
+func testStore(workerID string) *database.MemoryStore {
+	s := database.NewMemoryStore()
+	s.AddWorker(database.TCD_Employee{
+		Worker_ID:       workerID,
+		BYU_ID:          workerID,
+		Employee_Name:   "Cosmo Cougar",
+		Time_Code_Group: `[]`,
+		Positions:       `[{"position_number": "P1", "primary_position": true, "is_active_position": true, "business_title": "Mascot"}]`,
+	})
+	return s
+}
+
+// holds up a call until it is opened, like a dependency stuck on a call that ignores its context
+type gate struct {
+	release  chan struct{}
+	returned chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{release: make(chan struct{}), returned: make(chan struct{})}
+}
+
+func (g *gate) pass() {
+	<-g.release
+	close(g.returned)
+}
+
+// lets the held up call finish, and waits for it so it is done with the handlers' package variables
+func (g *gate) open(t *testing.T) {
+	close(g.release)
+	select {
+	case <-g.returned:
+	case <-time.After(5 * time.Second):
+		t.Error("the held up call never returned")
+	}
+}
+
+// a time data source that returns data and err, after waiting at gate if there is one
+type testTimeData struct {
+	data database.TimeData
+	err  error
+	gate *gate
+}
+
+func (s testTimeData) TimeData(ctx context.Context, workerID string, start time.Time, end time.Time) (database.TimeData, error) {
+	if s.gate != nil {
+		s.gate.pass()
+	}
+	return s.data, s.err
+}
+
+// a TCD whose pending punches wait at gate
+type slowPunchesStore struct {
+	*database.MemoryStore
+	gate *gate
+}
+
+func (s slowPunchesStore) PendingPunches(ctx context.Context, workerID string) ([]database.Punch, error) {
+	s.gate.pass()
+	return s.MemoryStore.PendingPunches(ctx, workerID)
+}
+
+// uses the default pay calendar until the test is done
+func usePayCalendar(t *testing.T) {
+	t.Helper()
+	calendar, err := paycalendar.New(paycalendar.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetPayCalendar(calendar)
+	t.Cleanup(func() { database.SetPayCalendar(nil) })
+}
+
+func getEmployeeData(t *testing.T, byuID string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/get_employee_data/:id", GetEmployeeData)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get_employee_data/"+byuID, nil))
+	return w
+}
+
+func sendPunch(t *testing.T, punch database.Punch) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/punch/:id", PostPunch)
+
+	body, _ := json.Marshal(punch)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/punch/"+punch.Worker_ID, bytes.NewReader(body)))
+	return w
+}
+
+func TestGetEmployeeDataLoginTimeout(t *testing.T) {
+	defer func(d time.Duration) { loginTimeout = d }(loginTimeout)
+	loginTimeout = 100 * time.Millisecond
+	usePayCalendar(t)
+
+	tests := []struct {
+		name          string
+		workerID      string
+		slowWorkday   bool
+		slowTCD       bool
+		wantWorkday   bool
+		wantTimeevent bool
+		wantError     string
+	}{
+		{name: "slow workday", workerID: "100000001", slowWorkday: true, wantTimeevent: true, wantError: "timed out waiting for workday"},
+		{name: "slow TCD", workerID: "100000002", slowTCD: true, wantWorkday: true, wantError: "timed out waiting for TCD timeevents"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := testStore(tt.workerID)
+			var s database.TCDStore = memory
+			source := testTimeData{}
+			g := newGate()
+			if tt.slowTCD {
+				s = slowPunchesStore{MemoryStore: memory, gate: g}
+			}
+			if tt.slowWorkday {
+				source.gate = g
+			}
+			SetStore(s)
+			defer SetStore(nil)
+			database.SetTimeDataSource(source)
+			defer database.SetTimeDataSource(nil)
+			defer g.open(t)
+			// a time sheet cached by an earlier run has to be fetched again
+			timeSheets.Invalidate(tt.workerID)
+
+			start := time.Now()
+			w := getEmployeeData(t, tt.workerID)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("GetEmployeeData took %s, want it cut off at %s", elapsed, loginTimeout)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("GetEmployeeData returned %d: %s", w.Code, w.Body)
+			}
+
+			var response EmployeeDataResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Status["workdayAPI_online"] != tt.wantWorkday || response.Status["TCD_timeevents_online"] != tt.wantTimeevent {
+				t.Errorf("got status %v, want workdayAPI_online %t and TCD_timeevents_online %t", response.Status, tt.wantWorkday, tt.wantTimeevent)
+			}
+			if !response.Status["TCD_employee_cache_online"] || response.Employee.Employee_Name != "Cosmo Cougar" || len(response.Employee.Positions) != 1 {
+				t.Errorf("got %+v, want the employee from the TCD", response.Employee)
+			}
+			if len(response.Error) != 1 || !strings.Contains(response.Error[0], tt.wantError) {
+				t.Errorf("got errors %q, want %q", response.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestGetEmployeeDataWorkdayErrors(t *testing.T) {
+	usePayCalendar(t)
+
+	tests := []struct {
+		name     string
+		workerID string
+		err      error
+		want     string
+	}{
+		{"report credentials", "100000011", &database.ReportError{Kind: database.ErrReportAuthentication}, "workday_auth_failed"},
+		{"report maintenance page", "100000012", &database.ReportError{Status: http.StatusOK, Kind: database.ErrReportMaintenance}, "workday_maintenance"},
+		{"report rejected", "100000013", &database.ReportError{Status: http.StatusBadRequest, Kind: database.ErrReportRejected}, "workday_rejected"},
+		{"validation fault", "100000014", fmt.Errorf("get calculated time blocks: %w", workday.ErrValidation), "workday_rejected"},
+		{"bad payload", "100000015", &database.ReportError{Kind: database.ErrReportPayload}, "workday_bad_payload"},
+		{"worker not in the report", "100000016", &database.ReportError{Status: http.StatusOK, Kind: database.ErrReportWorkerNotFound}, "workday_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetStore(testStore(tt.workerID))
+			defer SetStore(nil)
+			database.SetTimeDataSource(testTimeData{err: tt.err})
+			defer database.SetTimeDataSource(nil)
+			timeSheets.Invalidate(tt.workerID)
+
+			w := getEmployeeData(t, tt.workerID)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GetEmployeeData returned %d: %s", w.Code, w.Body)
+			}
+			var response EmployeeDataResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !response.Status[tt.want] {
+				t.Errorf("got status %v, want %s", response.Status, tt.want)
+			}
+			for _, s := range workdayErrorStatus {
+				if s.key != tt.want && response.Status[s.key] {
+					t.Errorf("got %s too, want only %s", s.key, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPostPunchConflict(t *testing.T) {
+	defer func(mode string) { punchConflictMode = mode }(punchConflictMode)
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+
+	now := time.Now()
+	clockedIn := database.TimeSheet{
+		Period_Blocks: []database.PeriodBlocks{{Position_Number: "P1", Time_Clock_Event_Date_Time_IN: now.Add(-time.Hour).Format("2006-01-02T15:04:05-07:00")}},
+		Fetched_At:    now,
+	}
+	clockedOut := database.TimeSheet{Fetched_At: now}
+
+	tests := []struct {
+		name      string
+		workerID  string
+		mode      string
+		timeSheet *database.TimeSheet
+		// invalidated is a time sheet from before a punch that has since been uploaded to Workday
+		invalidated bool
+		// tcd and queued are the punches that haven't made it to Workday yet
+		tcd          []database.Punch
+		queued       []database.Punch
+		punch        string
+		confirm      bool
+		wantCode     int
+		wantConflict string
+		wantConfirm  bool
+	}{
+		{name: "already clocked in", workerID: "200000001", mode: "confirm", timeSheet: &clockedIn, punch: "IN", wantCode: http.StatusConflict, wantConflict: ConflictAlreadyClockedIn, wantConfirm: true},
+		{name: "confirmed", workerID: "200000002", mode: "confirm", timeSheet: &clockedIn, punch: "IN", confirm: true, wantCode: http.StatusOK},
+		{name: "clocking out", workerID: "200000003", mode: "confirm", timeSheet: &clockedIn, punch: "OUT", wantCode: http.StatusOK},
+		{name: "confirmed in reject mode", workerID: "200000004", mode: "reject", timeSheet: &clockedIn, punch: "IN", confirm: true, wantCode: http.StatusConflict, wantConflict: ConflictAlreadyClockedIn},
+		{name: "off", workerID: "200000005", mode: "off", timeSheet: &clockedIn, punch: "IN", wantCode: http.StatusOK},
+		{name: "TCD punch without a time sheet", workerID: "200000006", mode: "confirm", tcd: []database.Punch{{Clock_Event_Type: "IN"}}, punch: "IN", wantCode: http.StatusConflict, wantConflict: ConflictAlreadyClockedIn, wantConfirm: true},
+		{name: "queued punch without a time sheet", workerID: "200000007", mode: "confirm", queued: []database.Punch{{Clock_Event_Type: "OUT"}}, punch: "OUT", wantCode: http.StatusConflict, wantConflict: ConflictNotClockedIn, wantConfirm: true},
+		{name: "nothing to check against", workerID: "200000008", mode: "confirm", punch: "OUT", wantCode: http.StatusOK},
+		{name: "time sheet from before the last punch", workerID: "200000009", mode: "confirm", timeSheet: &clockedOut, invalidated: true, punch: "OUT", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			punchConflictMode = tt.mode
+			if tt.timeSheet != nil {
+				timeSheets.Put(tt.workerID, *tt.timeSheet)
+			}
+			if tt.invalidated {
+				timeSheets.Invalidate(tt.workerID)
+			}
+			s := testStore(tt.workerID)
+			SetStore(s)
+			defer SetStore(nil)
+			for _, p := range tt.tcd {
+				p.Worker_ID, p.Position_Number, p.Time_Clock_Event_Date_Time = tt.workerID, "P1", now.Add(-time.Minute)
+				_, err := s.InsertPunch(context.Background(), p)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, p := range tt.queued {
+				p.Worker_ID, p.Position_Number, p.Time_Clock_Event_Date_Time = tt.workerID, "P1", now.Add(-time.Minute)
+				_, err := offline.Enqueue(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := sendPunch(t, database.Punch{Worker_ID: tt.workerID, Position_Number: "P1", Clock_Event_Type: tt.punch, Time_Entry_Code: "TC1", Confirm: tt.confirm})
+			if w.Code != tt.wantCode {
+				t.Fatalf("PostPunch returned %d: %s, want %d", w.Code, w.Body, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusConflict {
+				return
+			}
+			var conflict PunchConflict
+			err := json.Unmarshal(w.Body.Bytes(), &conflict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conflict.Code != tt.wantConflict || conflict.Confirm_Required != tt.wantConfirm || conflict.Message == "" {
+				t.Errorf("got conflict %+v, want %s with confirm_required %t", conflict, tt.wantConflict, tt.wantConfirm)
+			}
+		})
+	}
+}
+
+// a TCD that can't be reached, either refusing connections or hanging until the caller gives up
+type downStore struct {
+	*database.MemoryStore
+	hang  bool
+	calls []string
+}
+
+func (s *downStore) fail(ctx context.Context, call string) error {
+	s.calls = append(s.calls, call)
+	if s.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+func (s *downStore) FindPunch(ctx context.Context, punchID string) (database.PunchResponse, bool, error) {
+	return database.PunchResponse{}, false, s.fail(ctx, "FindPunch")
+}
+
+func (s *downStore) PendingPunches(ctx context.Context, workerID string) ([]database.Punch, error) {
+	return nil, s.fail(ctx, "PendingPunches")
+}
+
+func (s *downStore) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	return database.PunchResponse{}, s.fail(ctx, "InsertPunch")
+}
+
+func TestPostPunchTCDDown(t *testing.T) {
+	defer func(d time.Duration) { punchTimeout = d }(punchTimeout)
+	punchTimeout = 200 * time.Millisecond
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+
+	tests := []struct {
+		name     string
+		workerID string
+		punchID  string
+		hang     bool
+	}{
+		{name: "refusing connections", workerID: "400000001", punchID: "7d3f9a1e-5b2c-4e8d-a6f0-3c1b9e7d5a2f"},
+		{name: "hanging", workerID: "400000002", punchID: "2e8b4c6a-9f1d-4a3e-b5c7-8d0f2a4e6c1b", hang: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &downStore{MemoryStore: testStore(tt.workerID), hang: tt.hang}
+			SetStore(s)
+			defer SetStore(nil)
+
+			start := time.Now()
+			w := sendPunch(t, database.Punch{Worker_ID: tt.workerID, Position_Number: "P1", Clock_Event_Type: "IN", Time_Entry_Code: "TC1", Punch_ID: tt.punchID})
+			if elapsed := time.Since(start); elapsed > punchTimeout+time.Second {
+				t.Errorf("PostPunch took %s, want it queued within %s", elapsed, punchTimeout)
+			}
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"queued":"true"`) {
+				t.Fatalf("PostPunch returned %d: %s, want the punch queued", w.Code, w.Body)
+			}
+			// the punch is checked against the TCD once, and not sent to a TCD that is known to be down
+			if len(s.calls) != 1 {
+				t.Errorf("called %v, want only the first call to the TCD", s.calls)
+			}
+		})
+	}
+}
+
+func TestPostPunchConfirmedAfterSkew(t *testing.T) {
+	defer func(mode string, skew time.Duration) { punchConflictMode, punchClockSkew = mode, skew }(punchConflictMode, punchClockSkew)
+	punchConflictMode, punchClockSkew = "confirm", 5*time.Minute
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+	SetStore(testStore("500000001"))
+	defer SetStore(nil)
+
+	now := time.Now()
+	timeSheets.Put("500000001", database.TimeSheet{
+		Period_Blocks: []database.PeriodBlocks{{Position_Number: "P1", Time_Clock_Event_Date_Time_IN: now.Add(-time.Hour).Format("2006-01-02T15:04:05-07:00")}},
+		Fetched_At:    now,
+	})
+	punch := database.Punch{Worker_ID: "500000001", Position_Number: "P1", Clock_Event_Type: "IN", Time_Entry_Code: "TC1", Punch_ID: "5c9e1a7f-3b2d-4f6a-8e0c-9d1b7a5f3e2c", Time_Clock_Event_Date_Time: now.Add(-4 * time.Minute)}
+	if w := sendPunch(t, punch); w.Code != http.StatusConflict {
+		t.Fatalf("PostPunch returned %d: %s, want a conflict", w.Code, w.Body)
+	}
+
+	// the worker took long enough to answer that the punch time is now further off than the skew allows
+	punchClockSkew = time.Minute
+	other := punch
+	other.Punch_ID, other.Confirm = "1f7b3d9e-6a2c-4e8f-b0d4-7c5a9e3f1b6d", true
+	if w := sendPunch(t, other); w.Code != http.StatusBadRequest {
+		t.Errorf("PostPunch of an unknown confirmed punch returned %d: %s, want the skew error", w.Code, w.Body)
+	}
+	moved := punch
+	moved.Confirm, moved.Time_Clock_Event_Date_Time = true, now.Add(-10*time.Minute)
+	if w := sendPunch(t, moved); w.Code != http.StatusBadRequest {
+		t.Errorf("PostPunch of a confirmed punch with a new time returned %d: %s, want the skew error", w.Code, w.Body)
+	}
+	punch.Confirm = true
+	if w := sendPunch(t, punch); w.Code != http.StatusOK {
+		t.Errorf("PostPunch of the confirmed punch returned %d: %s", w.Code, w.Body)
+	}
+}
+
+// answers like Workday, with a new reference for every punch
+type workdayWriter struct {
+	sent int
+}
+
+func (w *workdayWriter) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	w.sent++
+	return database.PunchResponse{Clock_Event_Type: punch.Clock_Event_Type, Writen_To_TCD: "false", Queued: "false", Workday_Reference_ID: fmt.Sprintf("TCE-%d", w.sent)}, nil
+}
+
+func TestPostPunchClockEventType(t *testing.T) {
+	SetStore(testStore("300000002"))
+	defer SetStore(nil)
+	writer := &workdayWriter{}
+	SetPunchWriter(writer)
+	defer SetPunchWriter(nil)
+
+	for _, clockEventType := range []string{"in", "X", "Check-in"} {
+		w := sendPunch(t, database.Punch{Worker_ID: "300000002", Position_Number: "P1", Clock_Event_Type: clockEventType, Time_Entry_Code: "TC1"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PostPunch of %q returned %d: %s, want a 400", clockEventType, w.Code, w.Body)
+		}
+	}
+	if writer.sent != 0 {
+		t.Errorf("sent %d punches to workday, want none", writer.sent)
+	}
+}
+
+func TestPostPunchToWorkdayRetried(t *testing.T) {
+	err := offline.Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+	SetStore(testStore("300000001"))
+	defer SetStore(nil)
+	writer := &workdayWriter{}
+	SetPunchWriter(writer)
+	defer SetPunchWriter(nil)
+
+	punch := database.Punch{Worker_ID: "300000001", Position_Number: "P1", Clock_Event_Type: "IN", Time_Entry_Code: "TC1", Punch_ID: "9b2e7a4c-0d6f-4c1a-8e3b-5f7d9a1c2e4b"}
+	for i := 0; i < 2; i++ {
+		w := sendPunch(t, punch)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PostPunch returned %d: %s", w.Code, w.Body)
+		}
+		var response database.PunchResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Workday_Reference_ID != "TCE-1" {
+			t.Errorf("try %d got workday reference %q, want TCE-1", i+1, response.Workday_Reference_ID)
+		}
+	}
+	if writer.sent != 1 {
+		t.Errorf("sent the punch to workday %d times, want once", writer.sent)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer func(login, missingOut, skew, timeout time.Duration, mode string, sheets *database.TimeSheetCache) {
+		loginTimeout, missingOutAfter, punchClockSkew, punchTimeout, punchConflictMode, timeSheets = login, missingOut, skew, timeout, mode, sheets
+	}(loginTimeout, missingOutAfter, punchClockSkew, punchTimeout, punchConflictMode, timeSheets)
+
+	t.Setenv("LOGIN_TIMEOUT", "20s")
+	t.Setenv("PUNCH_CONFLICT_MODE", "sometimes")
+	t.Setenv("EMPLOYEE_CACHE_TTL", "-1m")
+	err := Setup()
+	var validation *config.ValidationError
+	if !errors.As(err, &validation) || len(validation.Problems) != 2 {
+		t.Fatalf("Setup() = %v, want problems with PUNCH_CONFLICT_MODE and EMPLOYEE_CACHE_TTL", err)
+	}
+	if loginTimeout == 20*time.Second {
+		t.Error("Setup() changed settings when some were invalid")
+	}
+
+	t.Setenv("PUNCH_CONFLICT_MODE", "off")
+	t.Setenv("EMPLOYEE_CACHE_TTL", "0")
+	t.Setenv("PUNCH_CLOCK_SKEW", "")
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if loginTimeout != 20*time.Second || punchConflictMode != "off" || punchClockSkew != 5*time.Minute {
+		t.Errorf("got login timeout %s, conflict mode %q and clock skew %s", loginTimeout, punchConflictMode, punchClockSkew)
+	}
+}
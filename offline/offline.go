@@ -0,0 +1,444 @@
+package offline
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+const (
+	PENDING_BUCKET = "PENDING"
+	ERROR_BUCKET   = "ERROR"
+	// SENT_BUCKET has the responses for punches sent straight to Workday, by punch_id, since they aren't in the TCD
+	SENT_BUCKET = "SENT"
+)
+
+// how long a sent punch is remembered, well past when a kiosk would still be retrying it
+const sentRetention = 7 * 24 * time.Hour
+
+// PunchWriter writes a single punch to the TCD
+type PunchWriter interface {
+	InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error)
+}
+
+// the response for a punch that was sent straight to Workday
+type sentPunch struct {
+	Response database.PunchResponse `json:"response"`
+	Sent_At  time.Time              `json:"sent_at"`
+}
+
+// a punch that could not be written to the TCD and the reason why
+type errorPunch struct {
+	Punch     database.Punch `json:"punch"`
+	Error     string         `json:"error"`
+	Failed_At time.Time      `json:"failed_at"`
+}
+
+var db *bolt.DB
+
+// Open opens (or creates) the local punch queue at path and makes sure the buckets exist
+func Open(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open offline punch queue at %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(PENDING_BUCKET))
+		if err != nil {
+			return fmt.Errorf("error creating the pending bucket: %w", err)
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(ERROR_BUCKET))
+		if err != nil {
+			return fmt.Errorf("error creating the error bucket: %w", err)
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(SENT_BUCKET))
+		if err != nil {
+			return fmt.Errorf("error creating the sent bucket: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("opened offline punch queue", "path", path, "pending", Count(PENDING_BUCKET), "errors", Count(ERROR_BUCKET))
+	return nil
+}
+
+// Close closes the local punch queue
+func Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.Close()
+}
+
+// Enqueue stores a punch in the pending bucket to be written to the TCD later and returns the queued punch.
+// punch.Time_Clock_Event_Date_Time must already be set so the original punch time is kept. If a punch with
+// the same Punch_ID is already queued it is left alone and returned instead.
+func Enqueue(punch database.Punch) (database.Punch, error) {
+	if db == nil {
+		return punch, fmt.Errorf("offline punch queue is not open")
+	}
+	if punch.Time_Clock_Event_Date_Time.IsZero() {
+		return punch, fmt.Errorf("punch must have a time_clock_event_date_time before it is queued")
+	}
+
+	value, err := json.Marshal(punch)
+	if err != nil {
+		return punch, fmt.Errorf("unable to marshal punch: %w", err)
+	}
+
+	queued := punch
+	var replayed bool
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PENDING_BUCKET))
+		if bucket == nil {
+			return fmt.Errorf("unable to access the pending bucket")
+		}
+		if original, ok := findPunch(bucket, punch.Punch_ID); ok {
+			queued, replayed = original, true
+			return nil
+		}
+		return bucket.Put(punchKey(punch), value)
+	})
+	if err != nil {
+		return punch, fmt.Errorf("unable to add punch to the pending bucket: %w", err)
+	}
+
+	if replayed {
+		slog.Info("punch already queued offline", "worker_id", punch.Worker_ID, "punch_id", punch.Punch_ID)
+		return queued, nil
+	}
+	slog.Info("punch queued offline", "worker_id", punch.Worker_ID, "clock_event_type", punch.Clock_Event_Type, "time", punch.Time_Clock_Event_Date_Time)
+	return queued, nil
+}
+
+// Find returns the queued punch with the given Punch_ID, if there is one
+func Find(punchID string) (database.Punch, bool, error) {
+	var punch database.Punch
+	var ok bool
+	if db == nil || punchID == "" {
+		return punch, false, nil
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PENDING_BUCKET))
+		if bucket == nil {
+			return fmt.Errorf("unable to access the pending bucket")
+		}
+		punch, ok = findPunch(bucket, punchID)
+		return nil
+	})
+	return punch, ok, err
+}
+
+// Remember keeps the response for a punch that was sent straight to Workday, so a retry of it can be
+// answered without sending it again. Punches without a Punch_ID or a Workday reference are skipped, and
+// punches older than a week are forgotten.
+func Remember(punch database.Punch, response database.PunchResponse) error {
+	if punch.Punch_ID == "" || response.Workday_Reference_ID == "" {
+		return nil
+	}
+	if db == nil {
+		return fmt.Errorf("offline punch queue is not open")
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return remember(tx, punch, response, time.Now())
+	})
+}
+
+func remember(tx *bolt.Tx, punch database.Punch, response database.PunchResponse, now time.Time) error {
+	bucket := tx.Bucket([]byte(SENT_BUCKET))
+	if bucket == nil {
+		return fmt.Errorf("unable to access the sent bucket")
+	}
+	value, err := json.Marshal(sentPunch{Response: response, Sent_At: now})
+	if err != nil {
+		return fmt.Errorf("unable to marshal sent punch: %w", err)
+	}
+	err = bucket.Put([]byte(punch.Punch_ID), value)
+	if err != nil {
+		return fmt.Errorf("unable to add punch to the sent bucket: %w", err)
+	}
+
+	var expired [][]byte
+	err = bucket.ForEach(func(key, value []byte) error {
+		var sent sentPunch
+		if json.Unmarshal(value, &sent) != nil || now.Sub(sent.Sent_At) > sentRetention {
+			expired = append(expired, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		err = bucket.Delete(key)
+		if err != nil {
+			return fmt.Errorf("unable to remove %s from the sent bucket: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Sent returns the response for the punch with the given Punch_ID, if it was sent straight to Workday
+func Sent(punchID string) (database.PunchResponse, bool, error) {
+	var sent sentPunch
+	var ok bool
+	if db == nil || punchID == "" {
+		return sent.Response, false, nil
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(SENT_BUCKET))
+		if bucket == nil {
+			return fmt.Errorf("unable to access the sent bucket")
+		}
+		value := bucket.Get([]byte(punchID))
+		if value == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(value, &sent)
+	})
+	return sent.Response, ok, err
+}
+
+// the queue is small, so it is scanned rather than indexed by Punch_ID
+func findPunch(bucket *bolt.Bucket, punchID string) (database.Punch, bool) {
+	var found database.Punch
+	if punchID == "" {
+		return found, false
+	}
+	errFound := errors.New("found")
+	err := bucket.ForEach(func(key, value []byte) error {
+		var punch database.Punch
+		if json.Unmarshal(value, &punch) == nil && punch.Punch_ID == punchID {
+			found = punch
+			return errFound
+		}
+		return nil
+	})
+	return found, errors.Is(err, errFound)
+}
+
+// Count returns the number of punches in the given bucket
+func Count(bucketName string) int {
+	if db == nil {
+		return 0
+	}
+	count := 0
+	_ = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	return count
+}
+
+// Pending returns the punches for a worker that are waiting in the queue, oldest first
+func Pending(workerID string) ([]database.Punch, error) {
+	var punches []database.Punch
+	if db == nil {
+		return punches, nil
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PENDING_BUCKET))
+		if bucket == nil {
+			return fmt.Errorf("unable to access the pending bucket")
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var punch database.Punch
+			err := json.Unmarshal(value, &punch)
+			if err != nil {
+				slog.Error("unable to unmarshal queued punch", "key", string(key), "error", err)
+				return nil
+			}
+			if punch.Worker_ID == workerID {
+				punches = append(punches, punch)
+			}
+			return nil
+		})
+	})
+	return punches, err
+}
+
+// Run drains the pending bucket into the TCD every interval until ctx is done
+func Run(ctx context.Context, interval time.Duration, writer PunchWriter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sent, failed, err := Drain(ctx, writer)
+			if err != nil {
+				slog.Warn("unable to drain offline punch queue", "error", err, "sent", sent, "failed", failed)
+			} else if sent > 0 || failed > 0 {
+				slog.Info("drained offline punch queue", "sent", sent, "failed", failed)
+			}
+		}
+	}
+}
+
+// Drain writes queued punches to the TCD oldest first. Punches that fail in a way sending them again won't
+// fix, or that Workday may already have, are moved to the error bucket, and draining stops at the first
+// error that can be retried.
+func Drain(ctx context.Context, writer PunchWriter) (sent int, failed int, err error) {
+	if db == nil {
+		return 0, 0, fmt.Errorf("offline punch queue is not open")
+	}
+
+	type queued struct {
+		key   []byte
+		punch database.Punch
+	}
+	var pending []queued
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PENDING_BUCKET))
+		if bucket == nil {
+			return fmt.Errorf("unable to access the pending bucket")
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var punch database.Punch
+			err := json.Unmarshal(value, &punch)
+			if err != nil {
+				slog.Error("unable to unmarshal queued punch", "key", string(key), "error", err)
+				return nil
+			}
+			pending = append(pending, queued{key: append([]byte(nil), key...), punch: punch})
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, q := range pending {
+		slog.Debug("resending queued punch", "key", string(q.key))
+		response, werr := writer.InsertPunch(ctx, q.punch)
+		if werr != nil && !IsPermanent(werr) {
+			return sent, failed, fmt.Errorf("TCD still unavailable: %w", werr)
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			if werr != nil {
+				value, err := json.Marshal(errorPunch{Punch: q.punch, Error: werr.Error(), Failed_At: time.Now()})
+				if err != nil {
+					return err
+				}
+				err = tx.Bucket([]byte(ERROR_BUCKET)).Put(q.key, value)
+				if err != nil {
+					return err
+				}
+			} else if q.punch.Punch_ID != "" && response.Workday_Reference_ID != "" {
+				err := remember(tx, q.punch, response, time.Now())
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Bucket([]byte(PENDING_BUCKET)).Delete(q.key)
+		})
+		if err != nil {
+			return sent, failed, fmt.Errorf("unable to remove punch %s from the pending bucket: %w", q.key, err)
+		}
+
+		if werr != nil {
+			slog.Error("TCD rejected queued punch, moved to error bucket", "key", string(q.key), "error", werr)
+			failed++
+			continue
+		}
+		sent++
+	}
+
+	return sent, failed, nil
+}
+
+// keys sort by punch time so punches are replayed in the order they happened
+func punchKey(punch database.Punch) []byte {
+	return []byte(fmt.Sprintf("%s-%s-%s", punch.Time_Clock_Event_Date_Time.UTC().Format("20060102T150405.000000000Z"), punch.Worker_ID, punch.Position_Number))
+}
+
+// IsUnreachable reports whether err means the TCD (or Workday) couldn't be reached or didn't answer in time,
+// so other calls to it made now would fail the same way
+func IsUnreachable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"57": // operator intervention, like a database that is shutting down
+			return true
+		}
+	}
+	return false
+}
+
+// IsPermanent reports whether a punch that failed with err should not be sent again. Only failures that
+// clearly happened before the TCD or Workday took the punch are worth queueing; anything else would be
+// refused again every time, or could record the punch twice.
+func IsPermanent(err error) bool {
+	return err != nil && !isRetryable(err)
+}
+
+func isRetryable(err error) bool {
+	switch {
+	case errors.Is(err, workday.ErrBadResponse):
+		// workday answered, so it may already have the punch
+		return false
+	case IsUnreachable(err), errors.Is(err, context.Canceled), errors.Is(err, workday.ErrCredentials):
+		return true
+	}
+
+	var fault *workday.Fault
+	if errors.As(err, &fault) {
+		// workday turned the punch away without recording it. Bad credentials are fixed on the clock, after
+		// which the punch can be sent again.
+		switch {
+		case fault.Kind == workday.ErrRateLimited, fault.Kind == workday.ErrAuthentication,
+			fault.Status == http.StatusBadGateway, fault.Status == http.StatusServiceUnavailable, fault.Status == http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// the TCD didn't write the punch, and skips it by punch_id if it is sent again after all
+		switch pqErr.Code.Class() {
+		case "40", // transaction rollback
+			"42", // syntax error or access rule violation, like a column whose migration hasn't run yet
+			"53", // insufficient resources
+			"58": // system error
+			return true
+		}
+	}
+	return false
+}
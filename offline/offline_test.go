@@ -0,0 +1,252 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/workday"
+)
+
+func openTestQueue(t *testing.T) {
+	t.Helper()
+	err := Open(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+}
+
+func testPunch(workerID string, minute int, punchID string) database.Punch {
+	return database.Punch{
+		Worker_ID:                  workerID,
+		Position_Number:            "P1",
+		Clock_Event_Type:           "IN",
+		Time_Entry_Code:            "TC1",
+		Punch_ID:                   punchID,
+		Time_Clock_Event_Date_Time: time.Date(2024, 3, 12, 8, minute, 0, 0, time.UTC),
+	}
+}
+
+// writes punches to a MemoryStore, except for workers it has an error for
+type scriptedWriter struct {
+	store  *database.MemoryStore
+	errors map[string]error
+	tried  []string
+}
+
+func (w *scriptedWriter) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	w.tried = append(w.tried, punch.Worker_ID)
+	if err := w.errors[punch.Worker_ID]; err != nil {
+		return database.PunchResponse{}, err
+	}
+	return w.store.InsertPunch(ctx, punch)
+}
+
+func TestEnqueueDedup(t *testing.T) {
+	openTestQueue(t)
+
+	first := testPunch("123456789", 0, "9b2e7a4c-0d6f-4c1a-8e3b-5f7d9a1c2e4b")
+	_, err := Enqueue(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a retry of the same punch, made a minute later, gets the original back
+	queued, err := Enqueue(testPunch("123456789", 1, first.Punch_ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queued.Time_Clock_Event_Date_Time.Equal(first.Time_Clock_Event_Date_Time) {
+		t.Errorf("got punch time %s, want the original %s", queued.Time_Clock_Event_Date_Time, first.Time_Clock_Event_Date_Time)
+	}
+	// punches without a punch_id are never treated as the same punch
+	for minute := 2; minute < 4; minute++ {
+		_, err = Enqueue(testPunch("123456789", minute, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := Count(PENDING_BUCKET); n != 3 {
+		t.Errorf("got %d queued punches, want 3", n)
+	}
+	punch, ok, err := Find(first.Punch_ID)
+	if err != nil || !ok || punch.Worker_ID != first.Worker_ID {
+		t.Errorf("Find() = %+v, %t, %v, want the first punch", punch, ok, err)
+	}
+}
+
+func TestDrainStopsWhenTCDIsDown(t *testing.T) {
+	openTestQueue(t)
+	for i, workerID := range []string{"111111111", "222222222", "333333333"} {
+		_, err := Enqueue(testPunch(workerID, i, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer := &scriptedWriter{store: database.NewMemoryStore(), errors: map[string]error{
+		"222222222": &pq.Error{Code: "08006", Message: "connection failure"},
+	}}
+	sent, failed, err := Drain(context.Background(), writer)
+	if err == nil || sent != 1 || failed != 0 {
+		t.Errorf("Drain() = %d, %d, %v, want 1 sent and an error", sent, failed, err)
+	}
+	if len(writer.tried) != 2 {
+		t.Errorf("tried %v, want draining to stop at the punch the TCD couldn't take", writer.tried)
+	}
+	if n := Count(PENDING_BUCKET); n != 2 {
+		t.Errorf("got %d queued punches, want 2 left for the next drain", n)
+	}
+
+	delete(writer.errors, "222222222")
+	sent, failed, err = Drain(context.Background(), writer)
+	if err != nil || sent != 2 || failed != 0 || Count(PENDING_BUCKET) != 0 {
+		t.Errorf("Drain() = %d, %d, %v, want the rest sent", sent, failed, err)
+	}
+}
+
+func TestDrainMovesRejectedPunches(t *testing.T) {
+	openTestQueue(t)
+	for i, workerID := range []string{"111111111", "222222222", "333333333"} {
+		_, err := Enqueue(testPunch(workerID, i, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer := &scriptedWriter{store: database.NewMemoryStore(), errors: map[string]error{
+		"111111111": &pq.Error{Code: "23502", Message: "null value in column \"position_id\""},
+		"222222222": fmt.Errorf("%w: clock_event_type \"X\" must be IN or OUT", database.ErrInvalidPunch),
+	}}
+	// neither refused punch holds up the one behind them
+	sent, failed, err := Drain(context.Background(), writer)
+	if err != nil || sent != 1 || failed != 2 {
+		t.Errorf("Drain() = %d, %d, %v, want 1 sent and 2 failed", sent, failed, err)
+	}
+	if Count(PENDING_BUCKET) != 0 || Count(ERROR_BUCKET) != 2 {
+		t.Errorf("got %d pending and %d errors, want the rejected punch in the error bucket", Count(PENDING_BUCKET), Count(ERROR_BUCKET))
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false},
+		{"timeout", fmt.Errorf("could not send Put_Time_Clock_Events request: %w", context.DeadlineExceeded), false},
+		{"connection failure", &pq.Error{Code: "08006"}, false},
+		{"missing column", &pq.Error{Code: "42703"}, false},
+		{"not null violation", &pq.Error{Code: "23502"}, true},
+		{"bad timestamp", &pq.Error{Code: "22007"}, true},
+		{"unrecognized", errors.New("something went wrong"), true},
+		{"invalid punch", fmt.Errorf("%w: clock_event_type \"in\" must be IN or OUT", database.ErrInvalidPunch), true},
+		{"no workday credentials", fmt.Errorf("%w for Put_Time_Clock_Events: %w", workday.ErrCredentials, errors.New("invalid token response")), false},
+		{"workday rate limit", &workday.Fault{Status: http.StatusTooManyRequests, Kind: workday.ErrRateLimited}, false},
+		{"workday unavailable", &workday.Fault{Status: http.StatusServiceUnavailable, Kind: workday.ErrServer}, false},
+		{"workday bad credentials", &workday.Fault{Status: http.StatusUnauthorized, Kind: workday.ErrAuthentication}, false},
+		{"workday processing error", &workday.Fault{Status: http.StatusInternalServerError, Kind: workday.ErrServer}, true},
+		{"workday validation fault", &workday.Fault{Status: http.StatusInternalServerError, Kind: workday.ErrValidation}, true},
+		{"workday response cut off", fmt.Errorf("%w: Put_Time_Clock_Events: %w", workday.ErrBadResponse, io.ErrUnexpectedEOF), true},
+		{"workday reference count", fmt.Errorf("%w: sent 1 time clock events to workday but got 0 references back", workday.ErrBadResponse), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Errorf("IsPermanent() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"timeout", fmt.Errorf("error querying timeevents: %w", context.DeadlineExceeded), true},
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"shutting down", &pq.Error{Code: "57P01"}, true},
+		{"missing column", &pq.Error{Code: "42703"}, false},
+		{"not null violation", &pq.Error{Code: "23502"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUnreachable(tt.err); got != tt.want {
+				t.Errorf("IsUnreachable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// answers like Workday, with a new reference for every punch
+type workdayWriter struct {
+	sent int
+}
+
+func (w *workdayWriter) InsertPunch(ctx context.Context, punch database.Punch) (database.PunchResponse, error) {
+	w.sent++
+	return database.PunchResponse{Clock_Event_Type: punch.Clock_Event_Type, Writen_To_TCD: "false", Queued: "false", Workday_Reference_ID: fmt.Sprintf("TCE-%d", w.sent)}, nil
+}
+
+func TestRememberSentPunches(t *testing.T) {
+	openTestQueue(t)
+
+	punch := testPunch("123456789", 0, "9b2e7a4c-0d6f-4c1a-8e3b-5f7d9a1c2e4b")
+	err := Remember(punch, database.PunchResponse{Workday_Reference_ID: "TCE-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, ok, err := Sent(punch.Punch_ID)
+	if err != nil || !ok || response.Workday_Reference_ID != "TCE-1" {
+		t.Errorf("Sent() = %+v, %t, %v, want TCE-1", response, ok, err)
+	}
+
+	// a queued punch drained into Workday is remembered too
+	queued := testPunch("123456789", 1, "4f1c8e2a-7b3d-4a5e-9c6f-0d2b8a1e3c7d")
+	_, err = Enqueue(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = Drain(context.Background(), &workdayWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, ok, err = Sent(queued.Punch_ID)
+	if err != nil || !ok || response.Workday_Reference_ID != "TCE-1" {
+		t.Errorf("Sent() of the drained punch = %+v, %t, %v, want TCE-1", response, ok, err)
+	}
+
+	// the first punch is forgotten once another is remembered more than a week later
+	err = db.Update(func(tx *bolt.Tx) error {
+		later := testPunch("123456789", 2, "c3a9e1f7-2d4b-4e6a-8f0c-1b5d7e9a3c2f")
+		return remember(tx, later, database.PunchResponse{Workday_Reference_ID: "TCE-3"}, time.Now().Add(sentRetention+time.Hour))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := Sent(punch.Punch_ID); ok {
+		t.Error("Sent() still has a punch from more than a week ago")
+	}
+	if n := Count(SENT_BUCKET); n != 1 {
+		t.Errorf("got %d sent punches, want 1", n)
+	}
+}
@@ -0,0 +1,269 @@
+// Package paycalendar works out which pay period and week a time falls in for the
+// pay schedule payroll is using.
+package paycalendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/config"
+)
+
+type Schedule string
+
+const (
+	Weekly      Schedule = "weekly"
+	Biweekly    Schedule = "biweekly"
+	SemiMonthly Schedule = "semi-monthly"
+)
+
+const dateLayout = "2006-01-02"
+
+// Config describes a pay calendar. It can be read from a JSON file, the environment, or both.
+type Config struct {
+	// Schedule is weekly, biweekly or semi-monthly
+	Schedule Schedule `json:"schedule"`
+	// Anchor_Date is the first day of any weekly or biweekly pay period, as 2006-01-02
+	Anchor_Date string `json:"anchor_date"`
+	// Week_Start is the day weekly hour totals start on. Defaults to the weekday of Anchor_Date
+	Week_Start string `json:"week_start"`
+	// Timezone is the IANA location pay periods are counted in
+	Timezone string `json:"timezone"`
+	// Overrides replace the computed period for the dates they cover, e.g. around year-end
+	Overrides []Override `json:"overrides"`
+}
+
+// Override is an explicit pay period. Weekly and biweekly periods after an override are counted
+// from the day after it ends.
+type Override struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// DefaultConfig is the calendar the timeclocks used before it was configurable
+func DefaultConfig() Config {
+	return Config{
+		Schedule:    Biweekly,
+		Anchor_Date: "2023-12-09",
+		Timezone:    "America/Denver",
+	}
+}
+
+// LoadConfig starts with DefaultConfig, replaces it with the JSON in PAY_CALENDAR (or the file in
+// PAY_CALENDAR_FILE) if it is set, and then applies PAY_SCHEDULE, PAY_PERIOD_ANCHOR, PAY_WEEK_START and
+// PAY_TIMEZONE on top. Problems are recorded on l.
+func LoadConfig(l *config.Loader) Config {
+	cfg := DefaultConfig()
+
+	if data := l.Get("PAY_CALENDAR"); data != "" {
+		err := json.Unmarshal([]byte(data), &cfg)
+		if err != nil {
+			l.Problem(fmt.Errorf("unable to parse PAY_CALENDAR: %w", err))
+		}
+	}
+
+	if v := l.Get("PAY_SCHEDULE"); v != "" {
+		cfg.Schedule = Schedule(v)
+	}
+	if v := l.Get("PAY_PERIOD_ANCHOR"); v != "" {
+		cfg.Anchor_Date = v
+	}
+	if v := l.Get("PAY_WEEK_START"); v != "" {
+		cfg.Week_Start = v
+	}
+	if v := l.Get("PAY_TIMEZONE"); v != "" {
+		cfg.Timezone = v
+	}
+	return cfg
+}
+
+// Period is a span of whole calendar days. Start is midnight at the beginning of the first day and
+// End is midnight at the beginning of the day after the last day, both in the calendar's location,
+// so a period is not always a multiple of 24 hours long when it crosses a daylight saving change.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains reports whether t is within the period
+func (p Period) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// FirstDay is the first day of the period as 2006-01-02
+func (p Period) FirstDay() string {
+	return p.Start.Format(dateLayout)
+}
+
+// LastDay is the last day of the period as 2006-01-02
+func (p Period) LastDay() string {
+	return p.End.AddDate(0, 0, -1).Format(dateLayout)
+}
+
+// ContainsDate reports whether the calendar date (as 2006-01-02) is one of the days in the period
+func (p Period) ContainsDate(date string) bool {
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return false
+	}
+	// dates in this layout sort the same as the days they represent
+	return date >= p.FirstDay() && date <= p.LastDay()
+}
+
+// Calendar answers which pay period or week a time falls in
+type Calendar struct {
+	schedule  Schedule
+	anchor    time.Time
+	weekStart time.Weekday
+	location  *time.Location
+	overrides []Period
+}
+
+// New validates cfg and builds a Calendar from it
+func New(cfg Config) (*Calendar, error) {
+	c := &Calendar{schedule: Schedule(strings.ToLower(string(cfg.Schedule)))}
+
+	switch c.schedule {
+	case Weekly, Biweekly, SemiMonthly:
+	case "":
+		c.schedule = Biweekly
+	default:
+		return nil, fmt.Errorf("unknown pay schedule %q, must be one of %s, %s, %s", cfg.Schedule, Weekly, Biweekly, SemiMonthly)
+	}
+
+	var err error
+	c.location = time.Local
+	if cfg.Timezone != "" {
+		c.location, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown pay calendar timezone %q: %w", cfg.Timezone, err)
+		}
+	}
+
+	if cfg.Anchor_Date == "" && c.schedule != SemiMonthly {
+		return nil, fmt.Errorf("an anchor date is required for a %s pay schedule", c.schedule)
+	}
+	if cfg.Anchor_Date != "" {
+		c.anchor, err = time.ParseInLocation(dateLayout, cfg.Anchor_Date, c.location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pay period anchor date %q: %w", cfg.Anchor_Date, err)
+		}
+	}
+
+	c.weekStart = c.anchor.Weekday()
+	if cfg.Week_Start != "" {
+		c.weekStart, err = parseWeekday(cfg.Week_Start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range cfg.Overrides {
+		start, err := time.ParseInLocation(dateLayout, o.Start, c.location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pay period override start %q: %w", o.Start, err)
+		}
+		end, err := time.ParseInLocation(dateLayout, o.End, c.location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pay period override end %q: %w", o.End, err)
+		}
+		if end.Before(start) {
+			return nil, fmt.Errorf("pay period override %s - %s ends before it starts", o.Start, o.End)
+		}
+		c.overrides = append(c.overrides, Period{Start: start, End: c.addDays(end, 1)})
+	}
+
+	return c, nil
+}
+
+// Location is the timezone the calendar counts days in
+func (c *Calendar) Location() *time.Location {
+	return c.location
+}
+
+// PeriodFor returns the pay period t falls in
+func (c *Calendar) PeriodFor(t time.Time) Period {
+	t = t.In(c.location)
+	for _, o := range c.overrides {
+		if o.Contains(t) {
+			return o
+		}
+	}
+
+	today := c.midnight(t)
+	switch c.schedule {
+	case SemiMonthly:
+		year, month, day := today.Date()
+		if day < 16 {
+			return Period{Start: time.Date(year, month, 1, 0, 0, 0, 0, c.location), End: time.Date(year, month, 16, 0, 0, 0, 0, c.location)}
+		}
+		return Period{Start: time.Date(year, month, 16, 0, 0, 0, 0, c.location), End: time.Date(year, month+1, 1, 0, 0, 0, 0, c.location)}
+	default:
+		periodDays := 14
+		if c.schedule == Weekly {
+			periodDays = 7
+		}
+		anchor := c.anchorFor(today)
+		periodsSince := floorDiv(daysBetween(anchor, today), periodDays)
+
+		start := c.addDays(anchor, periodsSince*periodDays)
+		return Period{Start: start, End: c.addDays(start, periodDays)}
+	}
+}
+
+// WeekFor returns the week t falls in, starting on the calendar's week start day
+func (c *Calendar) WeekFor(t time.Time) Period {
+	today := c.midnight(t)
+	daysIn := (int(today.Weekday()) - int(c.weekStart) + 7) % 7
+
+	start := c.addDays(today, -daysIn)
+	return Period{Start: start, End: c.addDays(start, 7)}
+}
+
+// weekly and biweekly periods are counted from the end of the latest override before today, if there is one
+func (c *Calendar) anchorFor(today time.Time) time.Time {
+	anchor := c.anchor
+	for _, o := range c.overrides {
+		if !o.End.After(today) && o.End.After(anchor) {
+			anchor = o.End
+		}
+	}
+	return anchor
+}
+
+// midnight at the start of the day t falls on in the calendar's location
+func (c *Calendar) midnight(t time.Time) time.Time {
+	year, month, day := t.In(c.location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, c.location)
+}
+
+// moves a midnight by whole calendar days, so the result is still a midnight across daylight saving changes
+func (c *Calendar) addDays(midnight time.Time, days int) time.Time {
+	year, month, day := midnight.In(c.location).Date()
+	return time.Date(year, month, day+days, 0, 0, 0, 0, c.location)
+}
+
+// the number of calendar days from a to b, ignoring how many hours long those days were
+func daysBetween(a, b time.Time) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return int(time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC).Sub(time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid week start day %q", s)
+}
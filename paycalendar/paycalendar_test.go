@@ -0,0 +1,256 @@
+package paycalendar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/config"
+)
+
+func mustNew(t *testing.T, cfg Config) *Calendar {
+	t.Helper()
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New(%+v): %s", cfg, err)
+	}
+	return c
+}
+
+func day(t *testing.T, c *Calendar, s string) time.Time {
+	t.Helper()
+	d, err := time.ParseInLocation(dateLayout, s, c.Location())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestPeriodFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		at        string
+		wantStart string
+		wantEnd   string
+	}{
+		{"biweekly default on anchor", DefaultConfig(), "2023-12-09", "2023-12-09", "2023-12-22"},
+		{"biweekly default later period", DefaultConfig(), "2024-01-10", "2024-01-06", "2024-01-19"},
+		{"weekly", Config{Schedule: Weekly, Anchor_Date: "2024-01-01", Timezone: "America/Denver"}, "2024-01-17", "2024-01-15", "2024-01-21"},
+		{"semi-monthly first half", Config{Schedule: SemiMonthly, Timezone: "America/Denver"}, "2024-02-15", "2024-02-01", "2024-02-15"},
+		{"semi-monthly second half", Config{Schedule: SemiMonthly, Timezone: "America/Denver"}, "2024-02-16", "2024-02-16", "2024-02-29"},
+		{
+			"override replaces the period",
+			Config{Schedule: Biweekly, Anchor_Date: "2023-12-09", Timezone: "America/Denver", Overrides: []Override{{Start: "2023-12-23", End: "2024-01-12"}}},
+			"2024-01-08", "2023-12-23", "2024-01-12",
+		},
+		{
+			"periods after an override count from its end",
+			Config{Schedule: Biweekly, Anchor_Date: "2023-12-09", Timezone: "America/Denver", Overrides: []Override{{Start: "2023-12-23", End: "2024-01-12"}}},
+			"2024-01-29", "2024-01-27", "2024-02-09",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustNew(t, tt.cfg)
+			got := c.PeriodFor(day(t, c, tt.at).Add(12 * time.Hour))
+			if got.FirstDay() != tt.wantStart || got.LastDay() != tt.wantEnd {
+				t.Errorf("PeriodFor(%s) = %s - %s, want %s - %s", tt.at, got.FirstDay(), got.LastDay(), tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestWeekFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		at        string
+		wantStart string
+	}{
+		{"defaults to the anchor weekday", DefaultConfig(), "2024-01-10", "2024-01-06"},
+		{"configured week start", Config{Schedule: Biweekly, Anchor_Date: "2023-12-09", Week_Start: "sunday", Timezone: "America/Denver"}, "2024-01-10", "2024-01-07"},
+		{"on the week start", Config{Schedule: SemiMonthly, Week_Start: "Mon", Timezone: "America/Denver"}, "2024-01-15", "2024-01-15"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustNew(t, tt.cfg)
+			got := c.WeekFor(day(t, c, tt.at).Add(12 * time.Hour))
+			if got.FirstDay() != tt.wantStart {
+				t.Errorf("WeekFor(%s) starts %s, want %s", tt.at, got.FirstDay(), tt.wantStart)
+			}
+		})
+	}
+}
+
+// times around daylight saving changes and period boundaries, in local wall clock time
+func TestPeriodForAcrossDST(t *testing.T) {
+	denver := DefaultConfig()
+	mondays := Config{Schedule: Weekly, Anchor_Date: "2024-10-28", Timezone: "America/Denver"}
+	utc := Config{Schedule: Biweekly, Anchor_Date: "2023-12-09", Timezone: "UTC"}
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		at        string
+		wantStart string
+		wantEnd   string
+		wantHours float64
+	}{
+		{"spring forward period", denver, "2024-03-10 12:00", "2024-03-02", "2024-03-15", 14*24 - 1},
+		{"first instant after a spring forward period", denver, "2024-03-16 00:00", "2024-03-16", "2024-03-29", 14 * 24},
+		{"just after midnight after spring forward", denver, "2024-03-16 00:30", "2024-03-16", "2024-03-29", 14 * 24},
+		{"last second of a spring forward period", denver, "2024-03-15 23:59:59", "2024-03-02", "2024-03-15", 14*24 - 1},
+		{"fall back period", denver, "2024-11-03 01:30", "2024-10-26", "2024-11-08", 14*24 + 1},
+		{"last second of a fall back period", denver, "2024-11-08 23:59:59", "2024-10-26", "2024-11-08", 14*24 + 1},
+		{"first instant after a fall back period", denver, "2024-11-09 00:00", "2024-11-09", "2024-11-22", 14 * 24},
+		{"late on a fall back day that ends the period", mondays, "2024-11-03 23:30", "2024-10-28", "2024-11-03", 7*24 + 1},
+		{"leap day", denver, "2024-02-29 12:00", "2024-02-17", "2024-03-01", 14 * 24},
+		{"day after leap day", denver, "2024-03-01 23:59:59", "2024-02-17", "2024-03-01", 14 * 24},
+		{"semi-monthly leap february", Config{Schedule: SemiMonthly, Timezone: "America/Denver"}, "2024-02-29 23:00", "2024-02-16", "2024-02-29", 14 * 24},
+		{"semi-monthly non-leap february", Config{Schedule: SemiMonthly, Timezone: "America/Denver"}, "2023-02-28 23:00", "2023-02-16", "2023-02-28", 13 * 24},
+		{"semi-monthly spring forward", Config{Schedule: SemiMonthly, Timezone: "America/Denver"}, "2024-03-10 03:00", "2024-03-01", "2024-03-15", 15*24 - 1},
+		{"before the anchor", denver, "2023-11-25 00:00", "2023-11-25", "2023-12-08", 14 * 24},
+		{"utc calendar is not shifted", utc, "2024-03-16 00:00", "2024-03-16", "2024-03-29", 14 * 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustNew(t, tt.cfg)
+			at, err := time.ParseInLocation("2006-01-02 15:04:05", withSeconds(tt.at), c.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := c.PeriodFor(at)
+			if got.FirstDay() != tt.wantStart || got.LastDay() != tt.wantEnd {
+				t.Errorf("PeriodFor(%s) = %s - %s, want %s - %s", tt.at, got.FirstDay(), got.LastDay(), tt.wantStart, tt.wantEnd)
+			}
+			if !got.Contains(at) {
+				t.Errorf("PeriodFor(%s) = %s - %s does not contain %s", tt.at, got.Start, got.End, at)
+			}
+			if hours := got.End.Sub(got.Start).Hours(); hours != tt.wantHours {
+				t.Errorf("PeriodFor(%s) is %v hours long, want %v", tt.at, hours, tt.wantHours)
+			}
+		})
+	}
+}
+
+func TestWeekForAcrossDST(t *testing.T) {
+	saturdays := DefaultConfig()
+	mondays := Config{Schedule: Biweekly, Anchor_Date: "2023-12-09", Week_Start: "monday", Timezone: "America/Denver"}
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		at        string
+		wantStart string
+		wantEnd   string
+	}{
+		{"spring forward week", saturdays, "2024-03-10 03:30", "2024-03-09", "2024-03-15"},
+		{"first instant after the spring forward week", saturdays, "2024-03-16 00:00", "2024-03-16", "2024-03-22"},
+		{"fall back week", saturdays, "2024-11-03 01:30", "2024-11-02", "2024-11-08"},
+		{"last hour of a week ending on fall back", mondays, "2024-11-03 23:30", "2024-10-28", "2024-11-03"},
+		{"last second of a week ending on spring forward", mondays, "2024-03-10 23:59:59", "2024-03-04", "2024-03-10"},
+		{"week across leap day", saturdays, "2024-02-29 12:00", "2024-02-24", "2024-03-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustNew(t, tt.cfg)
+			at, err := time.ParseInLocation("2006-01-02 15:04:05", withSeconds(tt.at), c.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := c.WeekFor(at)
+			if got.FirstDay() != tt.wantStart || got.LastDay() != tt.wantEnd {
+				t.Errorf("WeekFor(%s) = %s - %s, want %s - %s", tt.at, got.FirstDay(), got.LastDay(), tt.wantStart, tt.wantEnd)
+			}
+			if !got.Contains(at) {
+				t.Errorf("WeekFor(%s) = %s - %s does not contain %s", tt.at, got.Start, got.End, at)
+			}
+		})
+	}
+}
+
+// blocks are dated by calendar day, so the first and last day of a period are both in it and the
+// days either side are not
+func TestContainsDate(t *testing.T) {
+	c := mustNew(t, DefaultConfig())
+	period := c.PeriodFor(day(t, c, "2024-03-10"))
+
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2024-03-01", false},
+		{"2024-03-02", true},
+		{"2024-03-10", true},
+		{"2024-03-15", true},
+		{"2024-03-16", false},
+		{"2024-3-15", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := period.ContainsDate(tt.date); got != tt.want {
+			t.Errorf("%s - %s ContainsDate(%q) = %v, want %v", period.FirstDay(), period.LastDay(), tt.date, got, tt.want)
+		}
+	}
+}
+
+func withSeconds(s string) string {
+	if len(s) == len("2006-01-02 15:04") {
+		return s + ":00"
+	}
+	return s
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	bad := []Config{
+		{Schedule: "monthly", Anchor_Date: "2023-12-09"},
+		{Schedule: Biweekly},
+		{Schedule: Biweekly, Anchor_Date: "2023-Dec-09"},
+		{Schedule: Biweekly, Anchor_Date: "2023-12-09", Week_Start: "someday"},
+		{Schedule: Biweekly, Anchor_Date: "2023-12-09", Timezone: "Mars/Olympus_Mons"},
+		{Schedule: Biweekly, Anchor_Date: "2023-12-09", Overrides: []Override{{Start: "2024-01-12", End: "2023-12-23"}}},
+	}
+
+	for _, cfg := range bad {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) should have failed", cfg)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendar.json")
+	err := os.WriteFile(path, []byte(`{"schedule": "weekly", "anchor_date": "2024-01-06", "week_start": "saturday"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PAY_CALENDAR_FILE", path)
+	t.Setenv("PAY_TIMEZONE", "America/Phoenix")
+
+	var l config.Loader
+	cfg := LoadConfig(&l)
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := Config{Schedule: Weekly, Anchor_Date: "2024-01-06", Week_Start: "saturday", Timezone: "America/Phoenix"}
+	if cfg.Schedule != want.Schedule || cfg.Anchor_Date != want.Anchor_Date || cfg.Week_Start != want.Week_Start || cfg.Timezone != want.Timezone {
+		t.Errorf("LoadConfig() = %+v, want %+v", cfg, want)
+	}
+
+	t.Setenv("PAY_CALENDAR_FILE", "")
+	t.Setenv("PAY_CALENDAR", `{"schedule": `)
+	l = config.Loader{}
+	LoadConfig(&l)
+	if l.Err() == nil {
+		t.Error("LoadConfig() with bad JSON in PAY_CALENDAR recorded no problem")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -8,11 +10,15 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/byuoitav/workday-pi-time/config"
 	"github.com/byuoitav/workday-pi-time/database"
+	"github.com/byuoitav/workday-pi-time/event"
 	"github.com/byuoitav/workday-pi-time/handlers"
+	"github.com/byuoitav/workday-pi-time/offline"
 	"github.com/byuoitav/workday-pi-time/workday"
 )
 
@@ -42,6 +48,68 @@ func main() {
 		logger.Error("can not set log level", "error", err)
 	}
 
+	//read every setting up front so all of the problems with them are reported at once
+	var l config.Loader
+	retryInterval := l.DurationAtLeast("OFFLINE_RETRY_INTERVAL", 30*time.Second, time.Second)
+	reloadInterval := l.Duration("CONFIG_RELOAD_INTERVAL", time.Minute)
+	offlinePath := l.Get("OFFLINE_DB_PATH")
+	if offlinePath == "" {
+		offlinePath = "offline.db"
+	}
+	punchDestination := l.Get("PUNCH_DESTINATION")
+	switch punchDestination {
+	case "", "tcd", "workday":
+	default:
+		l.Problem(fmt.Errorf("PUNCH_DESTINATION must be tcd or workday, not %q", punchDestination))
+	}
+	err = errors.Join(workday.Setup(), database.Setup(), event.Setup(), handlers.Setup(), l.Err())
+	if err != nil {
+		logger.Error("can not start with this configuration", "error", err)
+		os.Exit(1)
+	}
+	go config.Run(context.Background(), reloadInterval)
+
+	tcd := database.DefaultStore()
+	handlers.SetStore(tcd)
+
+	//refuse to start against a TCD that is missing a migration, instead of failing every punch. If the TCD
+	//can't be reached punches are queued until it can, and are checked then.
+	err = tcd.CheckSchema(context.Background())
+	if errors.Is(err, database.ErrSchema) {
+		logger.Error("the TCD needs the migrations in database/migrations", "error", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		logger.Warn("can not check the TCD schema", "error", err)
+	}
+
+	//punches go to the TCD for the uploader unless this clock is set to send them straight to Workday
+	var punchWriter offline.PunchWriter = tcd
+	if punchDestination == "workday" {
+		logger.Info("sending punches straight to workday")
+		punchWriter = database.WorkdayPunchWriter{}
+		handlers.SetPunchWriter(punchWriter)
+	}
+
+	//pick up pay period overrides from the TCD, and keep checking in case they change or the TCD was down at boot
+	go database.RefreshPayCalendarOverrides(context.Background(), tcd)
+
+	//open the offline punch queue and start draining it
+	err = offline.Open(offlinePath)
+	if err != nil {
+		logger.Error("can not open offline punch queue", "error", err)
+		os.Exit(1)
+	}
+	defer offline.Close()
+	go offline.Run(context.Background(), retryInterval, punchWriter)
+
+	//send events to the event processor in the background so punches never wait on it
+	err = event.Start(context.Background())
+	if err != nil {
+		logger.Error("can not start sending events", "error", err)
+		os.Exit(1)
+	}
+
 	//start up a server to serve the angular site and set up the handlers for the UI to use
 	router := gin.Default()
 
@@ -63,6 +131,7 @@ func main() {
 	router.GET("/status", func(context *gin.Context) {
 		context.JSON(http.StatusOK, gin.H{
 			"message": "good",
+			"events":  event.Status(),
 		})
 	})
 
@@ -111,56 +180,7 @@ func main() {
 	})
 
 	//get and return all info to ui for employee
-	type employee_dataReturn struct {
-		Status        map[string]bool   `json:"status"`
-		Error         []string          `json:"error"`
-		Events_In_TCD int               `json:"unprocessed_punches_in_tcd"`
-		Employee      database.Employee `json:"employee"`
-	}
-	router.GET("/get_employee_data/:id", func(context *gin.Context) {
-		var employee database.Employee
-		var return_data employee_dataReturn
-		var err error
-
-		status := make(map[string]bool)
-		errSend := make(map[string]string)
-		online, err := handlers.GetEmployeeFromTCD(context, &employee)
-		if err != nil {
-			errSend["error"] = err.Error()
-			context.JSON(http.StatusServiceUnavailable, errSend)
-		} else {
-
-			online2, err := handlers.GetEmployeeFromWorkdayAPI(context, &employee)
-			if err != nil {
-				slog.Error("error with handlers.GetEmployeeFromWorkdayAPI ", "error", err)
-				return_data.Error = append(return_data.Error, err.Error())
-			}
-			count, online3, err := handlers.GetEmployeePunchesFromTCD(context, &employee)
-			if err != nil {
-				slog.Error("error with handlers.GetEmployeePunchesFromTCD ", "error", err)
-				return_data.Error = append(return_data.Error, err.Error())
-			}
-			err = handlers.DetermineIfClockedIn(&employee.Period_Blocks, &employee.Period_Punches, &employee)
-			if err != nil {
-				slog.Error("error with DetermineIfClockedIn ", "error", err)
-				return_data.Error = append(return_data.Error, err.Error())
-			}
-
-			status["TCD_employee_cache_online"] = online
-			status["workdayAPI_online"] = online2
-			status["TCD_timeevents_online"] = online3
-			if count > 0 {
-				status["unprocessed_punches_in_tcd"] = true
-			} else {
-				status["unprocessed_punches_in_tcd"] = false
-			}
-
-			return_data.Status = status
-			return_data.Employee = employee
-			return_data.Events_In_TCD = count
-			context.JSON(http.StatusOK, return_data)
-		}
-	})
+	router.GET("/get_employee_data/:id", handlers.GetEmployeeData)
 
 	//all of the functions to call to add / update / delete / do things on the UI
 
@@ -170,12 +190,16 @@ func main() {
 		handlers.PostPunch(context)
 	})
 
+	//pass an event from the UI on to the event processor
+	router.POST("/event", handlers.LocalOrToken, handlers.SendEventHandler)
+
 	router.GET("/getPunches/:id", func(context *gin.Context) {
 		var punches []database.Punch
 		workerID := context.Param("id")
-		punches, err := database.GetEmployeePunchesInTCD(workerID)
+		punches, err := tcd.PendingPunches(context.Request.Context(), workerID)
 		if err != nil {
-			context.JSON(http.StatusServiceUnavailable, err)
+			context.JSON(http.StatusServiceUnavailable, err.Error())
+			return
 		}
 		context.JSON(http.StatusOK, punches)
 	})
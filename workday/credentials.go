@@ -0,0 +1,224 @@
+package workday
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/workday-pi-time/config"
+)
+
+// Credentials authenticate requests to Workday
+type Credentials interface {
+	// Authorize adds an Authorization header to a request
+	Authorize(ctx context.Context, req *http.Request) error
+}
+
+// SOAPCredentials put a WS-Security header on SOAP envelopes instead of authorizing the HTTP request
+type SOAPCredentials interface {
+	Credentials
+	Security(ctx context.Context) (*Security, error)
+}
+
+// the credentials every Workday call uses - set with WORKDAY_AUTH
+var credentials atomic.Pointer[Credentials]
+
+// SetCredentials changes how Workday calls are authenticated
+func SetCredentials(c Credentials) {
+	credentials.Store(&c)
+}
+
+func currentCredentials() Credentials {
+	c := credentials.Load()
+	if c == nil {
+		return BasicCredentials{}
+	}
+	return *c
+}
+
+// Authorize adds the configured credentials to a request to Workday, such as a custom report
+func Authorize(ctx context.Context, req *http.Request) error {
+	return currentCredentials().Authorize(ctx, req)
+}
+
+// picks the credentials named by WORKDAY_AUTH: wssecurity (the default) for HTTP Basic auth on reports and
+// a WS-Security username token on SOAP calls, basic for HTTP Basic auth on both, or oauth2 for bearer
+// tokens from the refresh token flow against BDP_TOKEN_REFRESH_URL
+func credentialsFromConfig(l *config.Loader) Credentials {
+	switch mode := l.Get("WORKDAY_AUTH"); mode {
+	case "", "wssecurity":
+		return WSSecurityCredentials{Username: l.Required("WORKDAY_API_USER"), Tenant: l.Get("WORKDAY_API_TENANT"), Password: l.Required("WORKDAY_API_PASSWORD")}
+	case "basic":
+		return BasicCredentials{Username: l.Required("WORKDAY_API_USER"), Password: l.Required("WORKDAY_API_PASSWORD")}
+	case "oauth2":
+		return &OAuth2Credentials{
+			Token_URL:     l.Required("BDP_TOKEN_REFRESH_URL"),
+			Client_ID:     l.Required("WORKDAY_OAUTH_CLIENT_ID"),
+			Client_Secret: l.Required("WORKDAY_OAUTH_CLIENT_SECRET"),
+			Refresh_Token: l.Required("WORKDAY_OAUTH_REFRESH_TOKEN"),
+		}
+	default:
+		l.Problem(fmt.Errorf("WORKDAY_AUTH must be wssecurity, basic or oauth2, not %q", mode))
+		return nil
+	}
+}
+
+// BasicCredentials use HTTP Basic auth
+type BasicCredentials struct {
+	Username string
+	Password string
+}
+
+func (b BasicCredentials) Authorize(ctx context.Context, req *http.Request) error {
+	req.SetBasicAuth(b.Username, b.Password)
+	return nil
+}
+
+// WSSecurityCredentials send a plain text username token, as username@tenant, in SOAP envelopes. Requests
+// that aren't SOAP, like custom reports, get HTTP Basic auth with the username.
+type WSSecurityCredentials struct {
+	Username string
+	Tenant   string
+	Password string
+}
+
+func (w WSSecurityCredentials) Authorize(ctx context.Context, req *http.Request) error {
+	req.SetBasicAuth(w.Username, w.Password)
+	return nil
+}
+
+func (w WSSecurityCredentials) Security(ctx context.Context) (*Security, error) {
+	return &Security{
+		Must_Understand: "1",
+		Wsse_NS:         "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd",
+		Username:        w.Username + "@" + w.Tenant,
+		Password: Password{
+			Type:     "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText",
+			Password: w.Password,
+		},
+	}, nil
+}
+
+// OAuth2Credentials send a bearer token from the OAuth2 refresh token flow. The token is cached until it
+// expires, and renewed in the background once it is within Renew_Before of expiring.
+type OAuth2Credentials struct {
+	Token_URL     string
+	Client_ID     string
+	Client_Secret string
+	Refresh_Token string
+	// Renew_Before defaults to a minute
+	Renew_Before time.Duration
+
+	mu       sync.Mutex
+	token    string
+	expires  time.Time
+	renewing bool
+}
+
+type tokenResponse struct {
+	Access_Token  string `json:"access_token"`
+	Token_Type    string `json:"token_type"`
+	Expires_In    int    `json:"expires_in"`
+	Refresh_Token string `json:"refresh_token"`
+}
+
+func (o *OAuth2Credentials) Authorize(ctx context.Context, req *http.Request) error {
+	token, err := o.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns a cached access token, getting a new one first if there isn't one that is still good
+func (o *OAuth2Credentials) Token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	if o.token != "" && now.Before(o.expires) {
+		renewBefore := o.Renew_Before
+		if renewBefore <= 0 {
+			renewBefore = time.Minute
+		}
+		if !o.renewing && now.After(o.expires.Add(-renewBefore)) {
+			o.renewing = true
+			go o.renew(context.WithoutCancel(ctx))
+		}
+		return o.token, nil
+	}
+
+	err := o.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	return o.token, nil
+}
+
+// renews the token in the background, leaving the current one in place if it can't
+func (o *OAuth2Credentials) renew(ctx context.Context) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.renewing = false
+
+	err := o.refresh(ctx)
+	if err != nil {
+		slog.Warn("unable to renew workday access token", "error", err)
+	}
+}
+
+// gets a new access token; o.mu must be held
+func (o *OAuth2Credentials) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, workdayTimeout)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", o.Refresh_Token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Token_URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("could not make token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(o.Client_ID, o.Client_Secret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not refresh workday access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		kind := ErrServer
+		if resp.StatusCode < 500 {
+			kind = ErrAuthentication
+		}
+		return &Fault{Status: resp.StatusCode, Kind: kind, Operation: "refresh_token", RawResponse: strings.TrimSpace(string(body))}
+	}
+
+	var token tokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil || token.Access_Token == "" {
+		return fmt.Errorf("invalid token response: %s", strings.TrimSpace(string(body)))
+	}
+
+	o.token = token.Access_Token
+	o.expires = time.Now().Add(time.Duration(token.Expires_In) * time.Second)
+	if token.Refresh_Token != "" {
+		o.Refresh_Token = token.Refresh_Token
+	}
+	slog.Debug("refreshed workday access token", "expires", o.expires)
+	return nil
+}
@@ -0,0 +1,130 @@
+package workday
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hands out token-1, token-2... each good for expiresIn seconds
+func tokenServer(t *testing.T, expiresIn int) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var refreshTokens []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" || r.FormValue("grant_type") != "refresh_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client"}`)
+			return
+		}
+		mu.Lock()
+		refreshTokens = append(refreshTokens, r.FormValue("refresh_token"))
+		n := len(refreshTokens)
+		mu.Unlock()
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %d, "refresh_token": "refresh-%d"}`, n, expiresIn, n)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), refreshTokens...)
+	}
+}
+
+func TestOAuth2CredentialsCachesToken(t *testing.T) {
+	server, refreshes := tokenServer(t, 3600)
+	c := &OAuth2Credentials{Token_URL: server.URL, Client_ID: "client", Client_Secret: "secret", Refresh_Token: "refresh-0"}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		err := c.Authorize(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+			t.Errorf("Authorization = %q, want Bearer token-1", got)
+		}
+	}
+	if got := refreshes(); len(got) != 1 || got[0] != "refresh-0" {
+		t.Errorf("refreshed with %v, want one refresh with refresh-0", got)
+	}
+}
+
+func TestOAuth2CredentialsRenewsBeforeExpiry(t *testing.T) {
+	server, refreshes := tokenServer(t, 30)
+	c := &OAuth2Credentials{Token_URL: server.URL, Client_ID: "client", Client_Secret: "secret", Refresh_Token: "refresh-0", Renew_Before: time.Minute}
+
+	token, err := c.Token(context.Background())
+	if err != nil || token != "token-1" {
+		t.Fatalf("Token() = %q, %v, want token-1", token, err)
+	}
+	// token-1 is already within Renew_Before of expiring, so it is still used while token-2 is fetched
+	token, err = c.Token(context.Background())
+	if err != nil || token != "token-1" {
+		t.Fatalf("Token() = %q, %v, want token-1 while it is renewed", token, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(refreshes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	token, _ = c.Token(context.Background())
+	if token != "token-2" {
+		t.Errorf("Token() = %q after renewal, want token-2", token)
+	}
+	// the refresh token from the first response is used for the renewal
+	if got := refreshes(); len(got) < 2 || got[1] != "refresh-1" {
+		t.Errorf("refreshed with %v, want refresh-1 second", got)
+	}
+}
+
+func TestOAuth2CredentialsRejected(t *testing.T) {
+	server, _ := tokenServer(t, 3600)
+	c := &OAuth2Credentials{Token_URL: server.URL, Client_ID: "client", Client_Secret: "wrong", Refresh_Token: "refresh-0"}
+
+	_, err := c.Token(context.Background())
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Token() = %v, want %v", err, ErrAuthentication)
+	}
+}
+
+func TestSoapCallWithoutWSSecurity(t *testing.T) {
+	var authorization, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		fmt.Fprint(w, `<Envelope><Body><Get_Calculated_Time_Blocks_Response/></Body></Envelope>`)
+	}))
+	defer server.Close()
+	oldURL, oldCredentials := apiURL, currentCredentials()
+	apiURL = server.URL
+	SetCredentials(BasicCredentials{Username: "user", Password: "pass"})
+	defer func() {
+		apiURL = oldURL
+		SetCredentials(oldCredentials)
+	}()
+
+	_, err := soapCall(context.Background(), "Get_Calculated_Time_Blocks", "v41.0", GetCalculatedTimeBlocksRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("user", "pass")
+	if authorization != req.Header.Get("Authorization") {
+		t.Errorf("Authorization = %q, want basic auth for user", authorization)
+	}
+	if strings.Contains(body, "wsse:Security") {
+		t.Errorf("envelope should not have a WS-Security header:\n%s", body)
+	}
+}
@@ -0,0 +1,125 @@
+package workday
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Kinds of Workday failures. A *Fault unwraps to one of these, so callers can check errors.Is(err, ErrRateLimited).
+var (
+	ErrAuthentication = errors.New("workday rejected the integration credentials")
+	ErrInvalidWorker  = errors.New("workday does not know the worker")
+	ErrRateLimited    = errors.New("workday is rate limiting requests")
+	ErrServer         = errors.New("workday had a server error")
+	ErrValidation     = errors.New("workday rejected the request")
+)
+
+// Failures around a request rather than in Workday's answer to it
+var (
+	// ErrCredentials means the request was never sent, since the credentials for it couldn't be gotten
+	ErrCredentials = errors.New("could not get workday credentials")
+	// ErrBadResponse means Workday answered but the answer couldn't be read, so it may have done what was asked
+	ErrBadResponse = errors.New("workday sent a response that could not be read")
+	// ErrInvalidEvent means a time clock event was refused before it was sent
+	ErrInvalidEvent = errors.New("invalid time clock event")
+)
+
+// ValidationError is one of the errors in a Workday Validation_Fault
+type ValidationError struct {
+	Message        string `xml:"Message"`
+	Detail_Message string `xml:"Detail_Message"`
+	Xpath          string `xml:"Xpath"`
+}
+
+// Fault is a SOAP fault, or an error status without one, returned by Workday
+type Fault struct {
+	Status      int
+	Code        string
+	String      string
+	Validation  []ValidationError
+	Kind        error
+	Operation   string
+	RawResponse string
+}
+
+func (f *Fault) Error() string {
+	msg := f.String
+	if msg == "" {
+		msg = f.RawResponse
+	}
+	for _, v := range f.Validation {
+		if v.Detail_Message != "" && !strings.Contains(msg, v.Detail_Message) {
+			msg += "; " + v.Detail_Message
+		}
+	}
+	if f.Code != "" {
+		return fmt.Sprintf("%s: %s (%d %s): %s", f.Operation, f.Kind, f.Status, f.Code, msg)
+	}
+	return fmt.Sprintf("%s: %s (%d): %s", f.Operation, f.Kind, f.Status, msg)
+}
+
+func (f *Fault) Unwrap() error {
+	return f.Kind
+}
+
+// Temporary reports whether the same request may work if it is sent again later
+func (f *Fault) Temporary() bool {
+	return f.Kind == ErrRateLimited || f.Kind == ErrServer
+}
+
+type faultEnvelope struct {
+	Fault *struct {
+		Code       string            `xml:"faultcode"`
+		String     string            `xml:"faultstring"`
+		Validation []ValidationError `xml:"detail>Validation_Fault>Validation_Error"`
+	} `xml:"Body>Fault"`
+}
+
+// checkResponse returns a *Fault if Workday answered operation with an error status or a SOAP fault
+func checkResponse(operation string, status int, body []byte) error {
+	var envelope faultEnvelope
+	// a body that isn't XML is still an error if the status says so
+	_ = xml.Unmarshal(body, &envelope)
+	if envelope.Fault == nil && status >= 200 && status < 300 {
+		return nil
+	}
+
+	fault := &Fault{Status: status, Operation: operation}
+	if envelope.Fault != nil {
+		fault.Code = envelope.Fault.Code
+		fault.String = strings.TrimSpace(envelope.Fault.String)
+		fault.Validation = envelope.Fault.Validation
+	} else {
+		fault.RawResponse = strings.TrimSpace(string(body))
+		if len(fault.RawResponse) > 500 {
+			fault.RawResponse = fault.RawResponse[:500] + "..."
+		}
+	}
+	fault.Kind = classifyFault(fault)
+	return fault
+}
+
+func classifyFault(f *Fault) error {
+	code := strings.ToLower(f.Code)
+	text := strings.ToLower(f.String)
+	for _, v := range f.Validation {
+		text += " " + strings.ToLower(v.Message+" "+v.Detail_Message+" "+v.Xpath)
+	}
+
+	switch {
+	case f.Status == http.StatusUnauthorized || f.Status == http.StatusForbidden,
+		strings.Contains(code, "authentication"), strings.Contains(code, "authorization"),
+		strings.Contains(text, "invalid username or password"):
+		return ErrAuthentication
+	case f.Status == http.StatusTooManyRequests, strings.Contains(text, "rate limit"), strings.Contains(text, "too many requests"):
+		return ErrRateLimited
+	case strings.Contains(text, "employee_id"), strings.Contains(text, "worker_reference"):
+		return ErrInvalidWorker
+	case f.Status >= 500 && !strings.Contains(code, "client"), strings.Contains(code, "server"):
+		return ErrServer
+	}
+	return ErrValidation
+}
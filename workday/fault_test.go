@@ -0,0 +1,147 @@
+package workday
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+const faultTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/">
+    <SOAP-ENV:Body>
+        <SOAP-ENV:Fault xmlns:wd="urn:com.workday/bsvc">
+            <faultcode>%s</faultcode>
+            <faultstring>%s</faultstring>
+            <detail>
+                <wd:Validation_Fault>
+                    <wd:Validation_Error>
+                        <wd:Message>%s</wd:Message>
+                        <wd:Detail_Message>%s</wd:Detail_Message>
+                        <wd:Xpath>%s</wd:Xpath>
+                    </wd:Validation_Error>
+                </wd:Validation_Fault>
+            </detail>
+        </SOAP-ENV:Fault>
+    </SOAP-ENV:Body>
+</SOAP-ENV:Envelope>`
+
+func faultBody(code, str, message, detail, xpath string) []byte {
+	return []byte(fmt.Sprintf(faultTemplate, code, str, message, detail, xpath))
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+		want   error
+	}{
+		{"ok", http.StatusOK, []byte(`<Envelope><Body><Get_Calculated_Time_Blocks_Response/></Body></Envelope>`), nil},
+		{
+			"bad credentials", http.StatusInternalServerError,
+			faultBody("SOAP-ENV:Client.authenticationError", "invalid username or password", "", "", ""),
+			ErrAuthentication,
+		},
+		{"unauthorized status", http.StatusUnauthorized, []byte("Unauthorized"), ErrAuthentication},
+		{
+			"unknown worker", http.StatusInternalServerError,
+			faultBody("SOAP-ENV:Client.validationError", "Validation error occurred. Invalid ID value.", "Invalid ID value.",
+				"'123' is not a valid ID value for type = 'Employee_ID'", "/bsvc:Put_Time_Clock_Events_Request/bsvc:Time_Clock_Event/bsvc:Time_Clock_Event_Data/bsvc:Worker_Reference"),
+			ErrInvalidWorker,
+		},
+		{
+			"other validation error", http.StatusInternalServerError,
+			faultBody("SOAP-ENV:Client.validationError", "Validation error occurred. Time Entry Code is not valid.", "Time Entry Code is not valid.", "", ""),
+			ErrValidation,
+		},
+		{"rate limited", http.StatusTooManyRequests, []byte("Too Many Requests"), ErrRateLimited},
+		{
+			"server fault", http.StatusInternalServerError,
+			faultBody("SOAP-ENV:Server.processingError", "An unexpected error occurred", "", "", ""),
+			ErrServer,
+		},
+		{"gateway error without a fault", http.StatusBadGateway, []byte("<html>bad gateway</html>"), ErrServer},
+		{
+			"fault with an ok status", http.StatusOK,
+			faultBody("SOAP-ENV:Client.validationError", "Validation error occurred.", "", "", ""),
+			ErrValidation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResponse("Test_Operation", tt.status, tt.body)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("checkResponse() = %s, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("checkResponse() = %v, want %v", err, tt.want)
+			}
+			var fault *Fault
+			if !errors.As(err, &fault) || fault.Status != tt.status {
+				t.Errorf("checkResponse() = %#v, want a *Fault with status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestFaultTemporary(t *testing.T) {
+	for kind, want := range map[error]bool{
+		ErrAuthentication: false,
+		ErrInvalidWorker:  false,
+		ErrValidation:     false,
+		ErrRateLimited:    true,
+		ErrServer:         true,
+	} {
+		if got := (&Fault{Kind: kind}).Temporary(); got != want {
+			t.Errorf("Fault{Kind: %v}.Temporary() = %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func TestSortCalculatedTimeBlocks(t *testing.T) {
+	const blocks = `<Envelope><Body><Get_Calculated_Time_Blocks_Response><Response_Data>
+    <Calculated_Time_Block>
+        <Worker_Time_Block_Reference><ID type="WID">w1</ID><ID type="Calculated_Time_Block_ID">good</ID></Worker_Time_Block_Reference>
+        <Calculated_Time_Block_Data>
+            <In_Time>2024-03-12T08:00:00-06:00</In_Time>
+            <Out_Time>2024-03-12T12:00:00-06:00</Out_Time>
+            <Position_Reference><ID type="WID">p1</ID><ID type="Position_ID">12345</ID></Position_Reference>
+            <Calculated_Quantity>4</Calculated_Quantity>
+            <Status_Reference Descriptor="Approved"><ID type="Time_Tracking_Set_Up_Option_ID">Approved</ID></Status_Reference>
+            <Calculation_Tag_Reference Descriptor="Regular"><ID type="Time_Calculation_Tag_ID">Regular</ID></Calculation_Tag_Reference>
+        </Calculated_Time_Block_Data>
+    </Calculated_Time_Block>
+    <Calculated_Time_Block>
+        <Worker_Time_Block_Reference><ID type="WID">w2</ID><ID type="Calculated_Time_Block_ID">no-status</ID></Worker_Time_Block_Reference>
+        <Calculated_Time_Block_Data>
+            <Calculated_Quantity>1</Calculated_Quantity>
+            <Calculation_Tag_Reference Descriptor="Regular"><ID type="Time_Calculation_Tag_ID">Regular</ID></Calculation_Tag_Reference>
+        </Calculated_Time_Block_Data>
+    </Calculated_Time_Block>
+    <Calculated_Time_Block>
+        <Worker_Time_Block_Reference><ID type="WID">w3</ID><ID type="Calculated_Time_Block_ID">no-data</ID></Worker_Time_Block_Reference>
+    </Calculated_Time_Block>
+</Response_Data></Get_Calculated_Time_Blocks_Response></Body></Envelope>`
+
+	timeBlocks := make(map[string]WorkerTimeBlockInfo)
+	count, err := SortCalculatedTimeBlocks(timeBlocks, []byte(blocks))
+	if err == nil {
+		t.Error("SortCalculatedTimeBlocks() should report the blocks missing data")
+	}
+	if count != 1 || len(timeBlocks) != 1 {
+		t.Fatalf("SortCalculatedTimeBlocks() added %d blocks, want 1: %+v", count, timeBlocks)
+	}
+	if got := timeBlocks["good"]; got.Time_Tracking_Set_Up_Option_ID != "Approved" || got.Calculated_Quantity != "4" || got.Position_ID != "12345" {
+		t.Errorf("good block = %+v", got)
+	}
+
+	_, err = SortCalculatedTimeBlocks(timeBlocks, faultBody("SOAP-ENV:Server", "boom", "", "", ""))
+	if !errors.Is(err, ErrServer) {
+		t.Errorf("SortCalculatedTimeBlocks(fault) = %v, want %v", err, ErrServer)
+	}
+}
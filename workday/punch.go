@@ -0,0 +1,92 @@
+package workday
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// TimeClockEvent is a single punch to send to Workday with PutTimeClockEvents
+type TimeClockEvent struct {
+	Worker_ID   string
+	Position_ID string
+	// Clock_Event_Type is Check-in or Check-out
+	Clock_Event_Type string
+	// Time_Entry_Code is the time_code_reference_id from the TCD's time_entry_code_map
+	Time_Entry_Code string
+	Comment         string
+	Date_Time       time.Time
+}
+
+type putTimeClockEventsEnvelope struct {
+	Time_Clock_Event_Reference []struct {
+		ID []BlockID `xml:"ID"`
+	} `xml:"Body>Put_Time_Clock_Events_Response>Time_Clock_Event_Reference"`
+}
+
+// PutTimeClockEvents submits punches to Workday in one Put_Time_Clock_Events request and returns the
+// Workday reference ID of each, in the same order as events
+func PutTimeClockEvents(ctx context.Context, events []TimeClockEvent) ([]string, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	toSend := PutTimeClockEventsRequest{Version: "v41.1"}
+	for _, e := range events {
+		if e.Clock_Event_Type != "Check-in" && e.Clock_Event_Type != "Check-out" {
+			return nil, fmt.Errorf("%w: clock event type %q for worker %s must be Check-in or Check-out", ErrInvalidEvent, e.Clock_Event_Type, e.Worker_ID)
+		}
+		data := TimeClockEventData{
+			Worker_Reference:           reference("Employee_ID", e.Worker_ID),
+			Position_Reference:         reference("Position_ID", e.Position_ID),
+			Time_Clock_Event_Date_Time: e.Date_Time.Format(time.RFC3339),
+			Clock_Event_Type_Reference: reference("Time_Clock_Event_Type_ID", e.Clock_Event_Type),
+			Comment:                    e.Comment,
+		}
+		if e.Time_Entry_Code != "" {
+			timeEntryCode := reference("Time_Code_Reference_ID", e.Time_Entry_Code)
+			data.Time_Entry_Code_Reference = &timeEntryCode
+		}
+		toSend.Time_Clock_Event = append(toSend.Time_Clock_Event, TimeClockEventRequest{Time_Clock_Event_Data: data})
+	}
+
+	body, err := soapCall(ctx, "Put_Time_Clock_Events", toSend.Version, toSend)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope putTimeClockEventsEnvelope
+	err = xml.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not parse Put_Time_Clock_Events response: %w", ErrBadResponse, err)
+	}
+	if len(envelope.Time_Clock_Event_Reference) != len(events) {
+		return nil, fmt.Errorf("%w: sent %d time clock events to workday but got %d references back", ErrBadResponse, len(events), len(envelope.Time_Clock_Event_Reference))
+	}
+
+	referenceIDs := make([]string, len(events))
+	for i, ref := range envelope.Time_Clock_Event_Reference {
+		referenceIDs[i] = referenceID(ref.ID)
+	}
+	slog.Info("sent time clock events to workday", "count", len(events), "reference_ids", referenceIDs)
+	return referenceIDs, nil
+}
+
+// the Time_Clock_Event_ID if workday sent one, otherwise the WID
+func referenceID(ids []BlockID) string {
+	var wid string
+	for _, id := range ids {
+		switch id.Type {
+		case "Time_Clock_Event_ID":
+			return id.ID
+		case "WID":
+			wid = id.ID
+		}
+	}
+	if wid == "" && len(ids) > 0 {
+		return ids[0].ID
+	}
+	return wid
+}
@@ -0,0 +1,144 @@
+package workday
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Envelope is a SOAP request to a Workday web service. Element names carry their prefix so the
+// request matches what Workday documents, since encoding/xml can't pick namespace prefixes itself.
+type Envelope struct {
+	XMLName xml.Name `xml:"soap:Envelope"`
+	Soap_NS string   `xml:"xmlns:soap,attr"`
+	Bsvc_NS string   `xml:"xmlns:bsvc,attr"`
+	Header  Header   `xml:"soap:Header"`
+	Body    Body     `xml:"soap:Body"`
+}
+
+type Header struct {
+	Workday_Common_Header *CommonHeader `xml:"bsvc:Workday_Common_Header,omitempty"`
+	Security              *Security     `xml:"wsse:Security,omitempty"`
+}
+
+type CommonHeader struct {
+	Include_Reference_Descriptors_In_Response bool `xml:"bsvc:Include_Reference_Descriptors_In_Response"`
+}
+
+// Security is a WS-Security header with a plain text username token
+type Security struct {
+	Must_Understand string   `xml:"soap:mustUnderstand,attr"`
+	Wsse_NS         string   `xml:"xmlns:wsse,attr"`
+	Username        string   `xml:"wsse:UsernameToken>wsse:Username"`
+	Password        Password `xml:"wsse:UsernameToken>wsse:Password"`
+}
+
+type Password struct {
+	Type     string `xml:"Type,attr"`
+	Password string `xml:",chardata"`
+}
+
+// Body holds one request, which names its own element with an XMLName field
+type Body struct {
+	Request any
+}
+
+// RequestID is an ID in a request reference, the request form of BlockID
+type RequestID struct {
+	Type string `xml:"bsvc:type,attr"`
+	ID   string `xml:",chardata"`
+}
+
+// Reference points Workday at an object by one of its IDs
+type Reference struct {
+	ID []RequestID `xml:"bsvc:ID"`
+}
+
+func reference(idType string, id string) Reference {
+	return Reference{ID: []RequestID{{Type: idType, ID: id}}}
+}
+
+// GetCalculatedTimeBlocksRequest is the body of a Get_Calculated_Time_Blocks call
+type GetCalculatedTimeBlocksRequest struct {
+	XMLName          xml.Name           `xml:"bsvc:Get_Calculated_Time_Blocks_Request"`
+	Version          string             `xml:"bsvc:version,attr"`
+	Request_Criteria TimeBlocksCriteria `xml:"bsvc:Request_Criteria"`
+	Response_Filter  ResponseFilter     `xml:"bsvc:Response_Filter"`
+	Response_Group   ResponseGroup      `xml:"bsvc:Response_Group"`
+}
+
+type TimeBlocksCriteria struct {
+	Start_Date       string      `xml:"bsvc:Start_Date"`
+	End_Date         string      `xml:"bsvc:End_Date"`
+	Worker_Reference []Reference `xml:"bsvc:Worker_Reference"`
+}
+
+type ResponseFilter struct {
+	Page  int `xml:"bsvc:Page"`
+	Count int `xml:"bsvc:Count"`
+}
+
+// ResponseGroup picks what Workday includes with each calculated time block
+type ResponseGroup struct {
+	Include_Worker              bool `xml:"bsvc:Include_Worker"`
+	Include_Date                bool `xml:"bsvc:Include_Date"`
+	Include_In_Out_Time         bool `xml:"bsvc:Include_In_Out_Time"`
+	Include_Calculated_Quantity bool `xml:"bsvc:Include_Calculated_Quantity"`
+	Include_Status              bool `xml:"bsvc:Include_Status"`
+	Include_Deleted             bool `xml:"bsvc:Include_Deleted"`
+	Include_Calculation_Tags    bool `xml:"bsvc:Include_Calculation_Tags"`
+	Include_Last_Updated        bool `xml:"bsvc:Include_Last_Updated"`
+	Include_Worktags            bool `xml:"bsvc:Include_Worktags"`
+}
+
+// DefaultResponseGroup has everything SortCalculatedTimeBlocks needs
+var DefaultResponseGroup = ResponseGroup{
+	Include_Worker:              true,
+	Include_Date:                true,
+	Include_In_Out_Time:         true,
+	Include_Calculated_Quantity: true,
+	Include_Status:              true,
+	Include_Calculation_Tags:    true,
+	Include_Last_Updated:        true,
+	Include_Worktags:            true,
+}
+
+// PutTimeClockEventsRequest is the body of a Put_Time_Clock_Events call
+type PutTimeClockEventsRequest struct {
+	XMLName          xml.Name                `xml:"bsvc:Put_Time_Clock_Events_Request"`
+	Version          string                  `xml:"bsvc:version,attr"`
+	Time_Clock_Event []TimeClockEventRequest `xml:"bsvc:Time_Clock_Event"`
+}
+
+type TimeClockEventRequest struct {
+	Time_Clock_Event_Data TimeClockEventData `xml:"bsvc:Time_Clock_Event_Data"`
+}
+
+type TimeClockEventData struct {
+	Worker_Reference           Reference  `xml:"bsvc:Worker_Reference"`
+	Position_Reference         Reference  `xml:"bsvc:Position_Reference"`
+	Time_Clock_Event_Date_Time string     `xml:"bsvc:Time_Clock_Event_Date_Time"`
+	Clock_Event_Type_Reference Reference  `xml:"bsvc:Clock_Event_Type_Reference"`
+	Time_Entry_Code_Reference  *Reference `xml:"bsvc:Time_Entry_Code_Reference,omitempty"`
+	Comment                    string     `xml:"bsvc:Comment,omitempty"`
+}
+
+// newEnvelope wraps request, with a WS-Security header if security isn't nil
+func newEnvelope(request any, security *Security) Envelope {
+	return Envelope{
+		Soap_NS: "http://schemas.xmlsoap.org/soap/envelope/",
+		Bsvc_NS: "urn:com.workday/bsvc",
+		Header: Header{
+			Workday_Common_Header: &CommonHeader{Include_Reference_Descriptors_In_Response: true},
+			Security:              security,
+		},
+		Body: Body{Request: request},
+	}
+}
+
+func marshalEnvelope(envelope Envelope) ([]byte, error) {
+	body, err := xml.MarshalIndent(envelope, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal soap envelope: %w", err)
+	}
+	return append([]byte(xml.Header), body...), nil
+}
@@ -2,17 +2,17 @@ package workday
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
-)
+	"time"
 
-func init() {
-	fmt.Println("Workday Init")
-}
+	"github.com/byuoitav/workday-pi-time/config"
+)
 
 type WorkerTimeBlockInfo struct {
 	In_Time                        string
@@ -21,12 +21,22 @@ type WorkerTimeBlockInfo struct {
 	Time_Calculation_Tag_ID        string
 	Time_Tracking_Set_Up_Option_ID string
 	Worker_ID                      string
+	Position_ID                    string
 }
 
 type TimeBlockEnvelope struct {
+	Response_Results      ResponseResults       `xml:"Body>Get_Calculated_Time_Blocks_Response>Response_Results"`
 	Calculated_Time_Block []CalculatedTimeBlock `xml:"Body>Get_Calculated_Time_Blocks_Response>Response_Data>Calculated_Time_Block"`
 }
 
+// ResponseResults says which page of how many a response is
+type ResponseResults struct {
+	Total_Results int `xml:"Total_Results"`
+	Total_Pages   int `xml:"Total_Pages"`
+	Page_Results  int `xml:"Page_Results"`
+	Page          int `xml:"Page"`
+}
+
 type CalculatedTimeBlock struct {
 	Worker_Time_Block_Reference_ID []BlockID                 `xml:"Worker_Time_Block_Reference>ID"`
 	Calculated_Time_Block_Data     []CalculatedTimeBlockData `xml:"Calculated_Time_Block_Data"`
@@ -37,9 +47,11 @@ type BlockID struct {
 }
 
 type CalculatedTimeBlockData struct {
-	In_Time             string `xml:"In_Time"`
-	Out_Time            string `xml:"Out_Time"`
-	Calculated_Quantity string `xml:"Calculated_Quantity"`
+	Worker_Reference    []BlockID `xml:"Worker_Reference>ID"`
+	Position_Reference  []BlockID `xml:"Position_Reference>ID"`
+	In_Time             string    `xml:"In_Time"`
+	Out_Time            string    `xml:"Out_Time"`
+	Calculated_Quantity string    `xml:"Calculated_Quantity"`
 
 	Status_Reference          StatusReference         `xml:"Status_Reference"`
 	Calculation_Tag_Reference CalculationTagReference `xml:"Calculation_Tag_Reference"`
@@ -55,39 +67,79 @@ type CalculationTagReference struct {
 	Calculation_Tag_Reference            []BlockID `xml:"ID"`
 }
 
-var apiPassword, apiUser, apiURL, apiTenant string
+var apiURL, apiTenant string
 
-func init() {
+// how long a single SOAP call may take - set with WORKDAY_TIMEOUT
+var workdayTimeout = 10 * time.Second
 
-	getGlobalVars()
-}
+var client = &http.Client{Timeout: workdayTimeout}
 
-func getGlobalVars() {
-	apiUser = os.Getenv("WORKDAY_API_USER")
-	apiPassword = os.Getenv("WORKDAY_API_PASSWORD")
-	apiURL = os.Getenv("WORKDAY_API_URL")
-	apiTenant = os.Getenv("WORKDAY_API_TENANT")
-	if apiUser == "" || apiPassword == "" || apiURL == "" || apiTenant == "" {
-		slog.Error(`bdp package error
-		error getting environment variables. 
-		BDP_TOKEN_REFRESH_URL, WORKDAY_API_USER, WORKDAY_API_PASSWORD, WORKDAY_API_URL, WORKDAY_API_TENANT must be set to valid values. 
-		exiting`)
-		os.Exit(1)
+// Setup reads the Workday settings and credentials, returning everything wrong with them at once. Secrets
+// read from files are reloaded when the files change.
+func Setup() error {
+	var l config.Loader
+	apiURL = l.Required("WORKDAY_API_URL")
+	apiTenant = l.Required("WORKDAY_API_TENANT")
+	workdayTimeout = l.Duration("WORKDAY_TIMEOUT", 10*time.Second)
+	client.Timeout = workdayTimeout
+	c := credentialsFromConfig(&l)
+	err := l.Err()
+	if err != nil {
+		return err
 	}
+	SetCredentials(c)
+
+	for _, name := range []string{"WORKDAY_API_PASSWORD", "WORKDAY_OAUTH_CLIENT_SECRET", "WORKDAY_OAUTH_REFRESH_TOKEN"} {
+		config.Watch(name, func(string) {
+			var l config.Loader
+			c := credentialsFromConfig(&l)
+			if err := l.Err(); err != nil {
+				slog.Error("can not reload workday credentials, still using the old ones", "error", err)
+				return
+			}
+			SetCredentials(c)
+		})
+	}
+	slog.Info("workday settings", "apiURL", apiURL, "apiTenant", apiTenant, "timeout", workdayTimeout, "credentials", fmt.Sprintf("%T", c))
+	return nil
 }
 
+// SortCalculatedTimeBlocks adds the blocks in a Get_Calculated_Time_Blocks response to TimeBlocks and returns
+// how many were added. Blocks missing data are skipped and described in the returned error.
 func SortCalculatedTimeBlocks(TimeBlocks map[string]WorkerTimeBlockInfo, data []byte) (int, error) {
 	var block TimeBlockEnvelope
 
-	err := xml.Unmarshal(data, &block)
+	err := checkResponse("Get_Calculated_Time_Blocks", http.StatusOK, data)
+	if err != nil {
+		return 0, err
+	}
+	err = xml.Unmarshal(data, &block)
 	if err != nil {
 		return 0, err
 	}
 	count := 0
-	for _, v := range block.Calculated_Time_Block {
+	var errRtn error
+	for i, v := range block.Calculated_Time_Block {
 		if len(v.Worker_Time_Block_Reference_ID) > 1 {
+			if len(v.Calculated_Time_Block_Data) == 0 ||
+				len(v.Calculated_Time_Block_Data[0].Calculation_Tag_Reference.Calculation_Tag_Reference) == 0 ||
+				len(v.Calculated_Time_Block_Data[0].Status_Reference.Status_Reference) == 0 {
+				errRtn = errors.Join(errRtn, fmt.Errorf("calculated time block %d (%s) is missing its data, calculation tag or status", i, v.Worker_Time_Block_Reference_ID[1].ID))
+				continue
+			}
 			var timeBlock WorkerTimeBlockInfo
 			timeBlock.Worker_ID = v.Worker_Time_Block_Reference_ID[0].Type
+			//requests for more than one worker need to know whose block it is
+			for _, id := range v.Calculated_Time_Block_Data[0].Worker_Reference {
+				if id.Type == "Employee_ID" {
+					timeBlock.Worker_ID = id.ID
+				}
+			}
+			for _, id := range v.Calculated_Time_Block_Data[0].Position_Reference {
+				if id.Type == "Position_ID" {
+					timeBlock.Position_ID = id.ID
+				}
+			}
 
 			timeBlock.Calculated_Quantity = v.Calculated_Time_Block_Data[0].Calculated_Quantity
 			timeBlock.In_Time = v.Calculated_Time_Block_Data[0].In_Time
@@ -99,80 +151,155 @@ func SortCalculatedTimeBlocks(TimeBlocks map[string]WorkerTimeBlockInfo, data []
 			count++
 		}
 	}
-	return count, nil
+	return count, errRtn
 }
 
-func GetDataFromWorkday(workerID string, startDate string, endDate string) ([]byte, error) {
-	var body []byte
-	var err error
+// the most blocks workday will return in one page
+const maxPageSize = 999
 
-	// username, tenant, password, startDate, endDate, workerID
-	toSend := fmt.Sprintf(requestBody, apiUser, apiTenant, apiPassword, startDate, endDate, workerID)
+// TimeBlocksRequest is what to ask Get_Calculated_Time_Blocks for
+type TimeBlocksRequest struct {
+	Worker_IDs []string
+	Start_Date string
+	End_Date   string
+	// Page_Size defaults to, and can not be more than, 999
+	Page_Size int
+	// Worker_ID_Type is the kind of ID in Worker_IDs, Employee_ID by default or WID
+	Worker_ID_Type string
+	// Response_Group defaults to DefaultResponseGroup
+	Response_Group *ResponseGroup
+	// Version is the Get_Calculated_Time_Blocks API version, v41.0 by default
+	Version string
+}
 
-	url := apiURL + "/ccx/service/" + apiTenant + "/Time_Tracking/v41.1"
+// GetDataFromWorkday returns every page of calculated time blocks for a worker between the dates
+func GetDataFromWorkday(ctx context.Context, workerID string, startDate string, endDate string) ([][]byte, error) {
+	var pages [][]byte
+	err := GetCalculatedTimeBlocks(ctx, TimeBlocksRequest{Worker_IDs: []string{workerID}, Start_Date: startDate, End_Date: endDate}, func(page int, body []byte) error {
+		pages = append(pages, body)
+		return nil
+	})
+	return pages, err
+}
+
+// GetTimeBlocks returns the calculated time blocks from every page of the request by block ID
+func GetTimeBlocks(ctx context.Context, request TimeBlocksRequest) (map[string]WorkerTimeBlockInfo, error) {
+	timeBlocks := make(map[string]WorkerTimeBlockInfo)
+	var sortErr error
+	err := GetCalculatedTimeBlocks(ctx, request, func(page int, body []byte) error {
+		_, err := SortCalculatedTimeBlocks(timeBlocks, body)
+		sortErr = errors.Join(sortErr, err)
+		return nil
+	})
+	return timeBlocks, errors.Join(err, sortErr)
+}
+
+// GetCalculatedTimeBlocks requests each page of calculated time blocks in turn and passes the raw response
+// to fn as it arrives, so large supervisory requests don't have to be held in memory. It stops at the
+// first error from workday or fn.
+func GetCalculatedTimeBlocks(ctx context.Context, request TimeBlocksRequest, fn func(page int, body []byte) error) error {
+	if len(request.Worker_IDs) == 0 {
+		return fmt.Errorf("at least one worker is required to get calculated time blocks")
+	}
+	pageSize := request.Page_Size
+	if pageSize <= 0 || pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	toSend := GetCalculatedTimeBlocksRequest{
+		Version: request.Version,
+		Request_Criteria: TimeBlocksCriteria{
+			Start_Date: request.Start_Date,
+			End_Date:   request.End_Date,
+		},
+		Response_Filter: ResponseFilter{Count: pageSize},
+		Response_Group:  DefaultResponseGroup,
+	}
+	if toSend.Version == "" {
+		toSend.Version = "v41.0"
+	}
+	if request.Response_Group != nil {
+		toSend.Response_Group = *request.Response_Group
+	}
+	idType := request.Worker_ID_Type
+	if idType == "" {
+		idType = "Employee_ID"
+	}
+	for _, workerID := range request.Worker_IDs {
+		toSend.Request_Criteria.Worker_Reference = append(toSend.Request_Criteria.Worker_Reference, reference(idType, workerID))
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(toSend)))
+	for page := 1; ; page++ {
+		toSend.Response_Filter.Page = page
+		body, err := soapCall(ctx, "Get_Calculated_Time_Blocks", toSend.Version, toSend)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+
+		var envelope TimeBlockEnvelope
+		err = xml.Unmarshal(body, &envelope)
+		if err != nil {
+			return fmt.Errorf("could not parse page %d of calculated time blocks: %w", page, err)
+		}
+
+		err = fn(page, body)
+		if err != nil {
+			return err
+		}
+
+		slog.Debug("got calculated time blocks", "page", page, "total_pages", envelope.Response_Results.Total_Pages, "page_results", envelope.Response_Results.Page_Results)
+		if page >= envelope.Response_Results.Total_Pages {
+			return nil
+		}
+	}
+}
+
+// posts request in a SOAP envelope to the version of the Time_Tracking service the request is for, and returns
+// the response body. A fault comes back as a *Fault, which can be checked with errors.Is against ErrAuthentication etc.
+func soapCall(ctx context.Context, operation string, version string, request any) ([]byte, error) {
+	url := apiURL + "/ccx/service/" + apiTenant + "/Time_Tracking/" + version
+
+	// credentials that don't use WS-Security authorize the HTTP request instead
+	credentials := currentCredentials()
+	soapCredentials, wsSecurity := credentials.(SOAPCredentials)
+	var security *Security
+	if wsSecurity {
+		var err error
+		security, err = soapCredentials.Security(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %w", ErrCredentials, operation, err)
+		}
+	}
+
+	envelope, err := marshalEnvelope(newEnvelope(request, security))
+	if err != nil {
+		return nil, fmt.Errorf("could not make %s request: %w", operation, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, workdayTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(envelope))
 	if err != nil {
-		slog.Error("could not make request", "error", err)
-		return body, err
+		return nil, fmt.Errorf("could not make %s request: %w", operation, err)
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	if !wsSecurity {
+		err = credentials.Authorize(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %w", ErrCredentials, operation, err)
+		}
 	}
-	req.Header.Set("X-Custom-Header", "myvalue")
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		slog.Error("could not execute client.Do", "error", err)
-		return body, err
+		return nil, fmt.Errorf("could not send %s request: %w", operation, err)
 	}
 	defer resp.Body.Close()
 
-	//slog.Debug("response:", "response_status", resp.Status, "response_headers", resp.Header)
-	body, _ = io.ReadAll(resp.Body)
-
-	return body, err
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrBadResponse, operation, err)
+	}
+	return body, checkResponse(operation, resp.StatusCode, body)
 }
-
-// username, tenant, password, startDate, endDate, WorkerID
-const requestBody = `<?xml version="1.0" encoding="utf-8"?>
-<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:bsvc="urn:com.workday/bsvc">
-    <soap:Header>
-        <bsvc:Workday_Common_Header>
-            <bsvc:Include_Reference_Descriptors_In_Response>Y</bsvc:Include_Reference_Descriptors_In_Response>
-        </bsvc:Workday_Common_Header>
-        <wsse:Security 
-            soap:mustUnderstand="1"
-            xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">
-            <wsse:UsernameToken>
-                <wsse:Username>%s@%s</wsse:Username>
-                <wsse:Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText">%s</wsse:Password>
-            </wsse:UsernameToken>
-        </wsse:Security>
-    </soap:Header>
-    <soap:Body>
-        <bsvc:Get_Calculated_Time_Blocks_Request bsvc:version="v41.0">
-            <bsvc:Request_Criteria>
-                <bsvc:Start_Date>%s</bsvc:Start_Date>
-                <bsvc:End_Date>%s</bsvc:End_Date>
-                <bsvc:Worker_Reference bsvc:Descriptor="string">
-                    <bsvc:ID bsvc:type="Employee_ID">%s</bsvc:ID>
-                </bsvc:Worker_Reference>
-            </bsvc:Request_Criteria>
-            <bsvc:Response_Filter>
-                <bsvc:Page>1</bsvc:Page>
-                <bsvc:Count>999</bsvc:Count>
-            </bsvc:Response_Filter>
-            <bsvc:Response_Group>
-                <bsvc:Include_Worker>true</bsvc:Include_Worker>
-                <bsvc:Include_Date>true</bsvc:Include_Date>
-                <bsvc:Include_In_Out_Time>true</bsvc:Include_In_Out_Time>
-                <bsvc:Include_Calculated_Quantity>true</bsvc:Include_Calculated_Quantity>
-                <bsvc:Include_Status>true</bsvc:Include_Status>
-                <bsvc:Include_Deleted>false</bsvc:Include_Deleted>
-                <bsvc:Include_Calculation_Tags>true</bsvc:Include_Calculation_Tags>
-                <bsvc:Include_Last_Updated>true</bsvc:Include_Last_Updated>
-                <bsvc:Include_Worktags>true</bsvc:Include_Worktags>
-            </bsvc:Response_Group>
-        </bsvc:Get_Calculated_Time_Blocks_Request>
-    </soap:Body>
-</soap:Envelope>`
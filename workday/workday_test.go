@@ -0,0 +1,241 @@
+package workday
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// worker, block ID, page, total pages
+const timeBlocksPage = `<Envelope><Body><Get_Calculated_Time_Blocks_Response>
+<Response_Results><Total_Results>3</Total_Results><Total_Pages>%[4]d</Total_Pages><Page_Results>1</Page_Results><Page>%[3]d</Page></Response_Results>
+<Response_Data><Calculated_Time_Block>
+    <Worker_Time_Block_Reference><ID type="WID">wid</ID><ID type="Calculated_Time_Block_ID">%[2]s</ID></Worker_Time_Block_Reference>
+    <Calculated_Time_Block_Data>
+        <Worker_Reference><ID type="WID">wid</ID><ID type="Employee_ID">%[1]s</ID></Worker_Reference>
+        <Calculated_Quantity>1</Calculated_Quantity>
+        <Status_Reference><ID type="Time_Tracking_Set_Up_Option_ID">Approved</ID></Status_Reference>
+        <Calculation_Tag_Reference><ID type="Time_Calculation_Tag_ID">Regular</ID></Calculation_Tag_Reference>
+    </Calculated_Time_Block_Data>
+</Calculated_Time_Block></Response_Data>
+</Get_Calculated_Time_Blocks_Response></Body></Envelope>`
+
+// serves totalPages pages with one block each, alternating between the workers in the request
+func timeBlocksServer(t *testing.T, totalPages int) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+	pagePattern := regexp.MustCompile(`<bsvc:Page>(\d+)</bsvc:Page>`)
+	workerPattern := regexp.MustCompile(`bsvc:type="[^"]+">([^<]+)<`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, string(body))
+		mu.Unlock()
+
+		page, _ := strconv.Atoi(pagePattern.FindStringSubmatch(string(body))[1])
+		workers := workerPattern.FindAllStringSubmatch(string(body), -1)
+		worker := workers[(page-1)%len(workers)][1]
+		fmt.Fprintf(w, timeBlocksPage, worker, fmt.Sprintf("block-%d", page), page, totalPages)
+	}))
+	t.Cleanup(server.Close)
+
+	oldURL := apiURL
+	apiURL = server.URL
+	t.Cleanup(func() { apiURL = oldURL })
+	return server, &requests
+}
+
+func TestGetCalculatedTimeBlocksReadsEveryPage(t *testing.T) {
+	_, requests := timeBlocksServer(t, 3)
+
+	var pages []int
+	err := GetCalculatedTimeBlocks(context.Background(), TimeBlocksRequest{Worker_IDs: []string{"111"}, Start_Date: "2024-03-01", End_Date: "2024-03-15", Page_Size: 1}, func(page int, body []byte) error {
+		pages = append(pages, page)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pages) != "[1 2 3]" {
+		t.Errorf("got pages %v, want [1 2 3]", pages)
+	}
+	if !strings.Contains((*requests)[0], "<bsvc:Count>1</bsvc:Count>") {
+		t.Errorf("request did not use the page size: %s", (*requests)[0])
+	}
+}
+
+func TestGetCalculatedTimeBlocksStopsOnCallbackError(t *testing.T) {
+	_, requests := timeBlocksServer(t, 3)
+
+	stop := fmt.Errorf("stop")
+	err := GetCalculatedTimeBlocks(context.Background(), TimeBlocksRequest{Worker_IDs: []string{"111"}}, func(page int, body []byte) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("GetCalculatedTimeBlocks() = %v, want %v", err, stop)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("made %d requests after the callback failed, want 1", len(*requests))
+	}
+}
+
+func TestGetTimeBlocksForSeveralWorkers(t *testing.T) {
+	_, requests := timeBlocksServer(t, 2)
+
+	timeBlocks, err := GetTimeBlocks(context.Background(), TimeBlocksRequest{Worker_IDs: []string{"111", "222"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeBlocks["block-1"].Worker_ID != "111" || timeBlocks["block-2"].Worker_ID != "222" {
+		t.Errorf("GetTimeBlocks() = %+v, want block-1 for 111 and block-2 for 222", timeBlocks)
+	}
+	if strings.Count((*requests)[0], "<bsvc:Worker_Reference>") != 2 {
+		t.Errorf("request should reference both workers: %s", (*requests)[0])
+	}
+	if !strings.Contains((*requests)[0], "<bsvc:Count>999</bsvc:Count>") {
+		t.Errorf("request should default to the largest page size: %s", (*requests)[0])
+	}
+}
+
+func TestGetCalculatedTimeBlocksSinglePageWithoutResults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<Envelope><Body><Get_Calculated_Time_Blocks_Response/></Body></Envelope>`)
+	}))
+	defer server.Close()
+	oldURL := apiURL
+	apiURL = server.URL
+	defer func() { apiURL = oldURL }()
+
+	pages, err := GetDataFromWorkday(context.Background(), "111", "2024-03-01", "2024-03-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 {
+		t.Errorf("got %d pages, want 1", len(pages))
+	}
+}
+
+func TestEnvelopeEscapesCredentials(t *testing.T) {
+	const password = `p<a&s"s>`
+	security, err := WSSecurityCredentials{Username: "u", Tenant: "t", Password: password}.Security(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := marshalEnvelope(newEnvelope(GetCalculatedTimeBlocksRequest{Version: "v41.0"}, security))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		Password string `xml:"Header>Security>UsernameToken>Password"`
+	}
+	err = xml.Unmarshal(body, &parsed)
+	if err != nil {
+		t.Fatalf("envelope is not valid xml: %s\n%s", err, body)
+	}
+	if parsed.Password != password {
+		t.Errorf("got password %q, want %q", parsed.Password, password)
+	}
+}
+
+func TestGetCalculatedTimeBlocksRequestOptions(t *testing.T) {
+	_, requests := timeBlocksServer(t, 1)
+
+	err := GetCalculatedTimeBlocks(context.Background(), TimeBlocksRequest{
+		Worker_IDs:     []string{"abc123"},
+		Worker_ID_Type: "WID",
+		Response_Group: &ResponseGroup{Include_Status: true},
+		Version:        "v42.0",
+	}, func(page int, body []byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := (*requests)[0]
+	for _, want := range []string{
+		`bsvc:version="v42.0"`,
+		`<bsvc:ID bsvc:type="WID">abc123</bsvc:ID>`,
+		`<bsvc:Include_Status>true</bsvc:Include_Status>`,
+		`<bsvc:Include_Worker>false</bsvc:Include_Worker>`,
+	} {
+		if !strings.Contains(request, want) {
+			t.Errorf("request is missing %s:\n%s", want, request)
+		}
+	}
+}
+
+func TestSOAPCallUsesRequestVersion(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, `<Envelope><Body><Get_Calculated_Time_Blocks_Response/></Body></Envelope>`)
+	}))
+	defer server.Close()
+	oldURL, oldTenant := apiURL, apiTenant
+	apiURL, apiTenant = server.URL, "byu"
+	defer func() { apiURL, apiTenant = oldURL, oldTenant }()
+
+	for _, version := range []string{"", "v42.0"} {
+		err := GetCalculatedTimeBlocks(context.Background(), TimeBlocksRequest{Worker_IDs: []string{"111"}, Version: version}, func(page int, body []byte) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "[/ccx/service/byu/Time_Tracking/v41.0 /ccx/service/byu/Time_Tracking/v42.0]"
+	if fmt.Sprint(paths) != want {
+		t.Errorf("got paths %v, want %s", paths, want)
+	}
+}
+
+func TestPutTimeClockEventsErrors(t *testing.T) {
+	var requests int
+	var response string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+	oldURL, oldTenant := apiURL, apiTenant
+	apiURL, apiTenant = server.URL, "byu"
+	defer func() { apiURL, apiTenant = oldURL, oldTenant }()
+	SetCredentials(BasicCredentials{Username: "ISU_INT265", Password: "password"})
+
+	event := TimeClockEvent{Worker_ID: "123456789", Position_ID: "P1", Clock_Event_Type: "Check-in", Date_Time: time.Now()}
+	tests := []struct {
+		name     string
+		event    TimeClockEvent
+		response string
+		want     error
+		requests int
+	}{
+		{name: "invalid event type", event: TimeClockEvent{Worker_ID: "123456789", Clock_Event_Type: "in"}, want: ErrInvalidEvent},
+		{name: "no references", event: event, response: `<Envelope><Body><Put_Time_Clock_Events_Response/></Body></Envelope>`, want: ErrBadResponse, requests: 1},
+		{name: "not xml", event: event, response: `OK`, want: ErrBadResponse, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, response = 0, tt.response
+			_, err := PutTimeClockEvents(context.Background(), []TimeClockEvent{tt.event})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("PutTimeClockEvents() error = %v, want %v", err, tt.want)
+			}
+			if requests != tt.requests {
+				t.Errorf("sent %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}